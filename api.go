@@ -8,69 +8,104 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
 )
 
-func jsonPost(writer io.Writer, url string, activityFriendlyName string, postValues interface{}) (result map[string]interface{}, err error) {
+func jsonPost(url string, activityFriendlyName string, postValues interface{}, dryRun bool) (result map[string]interface{}, err error) {
 
 	log.Printf("postValues: %+v", postValues)
 
 	requestBody, err := json.Marshal(postValues)
 	if err != nil {
 		log.Printf("Error serialising %s request to JSON: %v", activityFriendlyName, err)
-		writeVarnishCliResponse(writer, CLIS_CANT, "Failed to serialise the "+activityFriendlyName+" API request.")
-		return nil, err
+		return nil, fmt.Errorf("Failed to serialise the %s API request.", activityFriendlyName)
 	}
 
-	log.Printf("url: %s", url)
 	log.Printf("requestBody: %s", string(requestBody))
-	request, err := http.NewRequest("POST", url, bytes.NewReader(requestBody))
+	return jsonRequest("POST", url, activityFriendlyName, bytes.NewReader(requestBody), dryRun)
+}
+
+func jsonGet(url string, activityFriendlyName string) (result map[string]interface{}, err error) {
+	return jsonRequest("GET", url, activityFriendlyName, nil, false)
+}
+
+// jsonRequest calls the section.io API, returning an error suitable for the
+// CLI response when the call fails.
+func jsonRequest(method string, url string, activityFriendlyName string, requestBody io.Reader, dryRun bool) (result map[string]interface{}, err error) {
+
+	log.Printf("url: %s", url)
+	request, err := http.NewRequest(method, url, requestBody)
 	if err != nil {
 		log.Printf("Error composing %s request: %v", activityFriendlyName, err)
-		writeVarnishCliResponse(writer, CLIS_CANT, "Failed to compose the "+activityFriendlyName+" API request.")
-		return nil, err
+		return nil, fmt.Errorf("Failed to compose the %s API request.", activityFriendlyName)
 	}
 
 	request.Header.Set("User-Agent", userAgent)
-	request.Header.Set("Content-Type", "application/json")
+	if requestBody != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
 	request.SetBasicAuth(sectionioUsername, sectionioPassword)
 	//log.Printf("sectionioUsername, sectionioPassword %s %s", sectionioUsername, sectionioPassword)
 
-	localResponse, err := httpClient.Do(request)
+	localResponse, err := sendApiRequest(request, dryRun)
 	if err != nil {
-		log.Printf("Error posting %s request: %v", activityFriendlyName, err)
-		writeVarnishCliResponse(writer, CLIS_CANT, "Failed to post the "+activityFriendlyName+".")
-		return nil, err
+		log.Printf("Error sending %s request: %v", activityFriendlyName, err)
+		return nil, fmt.Errorf("Failed to send the %s request.", activityFriendlyName)
 	}
 
-	var responseBodyText string
-	var responseBodyBytes []byte
-	func() {
-		defer localResponse.Body.Close()
-		responseBodyBytes, err = ioutil.ReadAll(localResponse.Body)
-		if err != nil {
-			log.Printf("Error reading %s API response: %v", activityFriendlyName, err)
-			writeVarnishCliResponse(writer, CLIS_CANT, "Failed to parse the "+activityFriendlyName+" API response.")
-			return
-		}
-		responseBodyText = string(responseBodyBytes)
-	}()
+	defer localResponse.Body.Close()
+	responseBodyBytes, err := ioutil.ReadAll(localResponse.Body)
 	if err != nil {
-		return nil, err
+		log.Printf("Error reading %s API response: %v", activityFriendlyName, err)
+		return nil, fmt.Errorf("Failed to parse the %s API response.", activityFriendlyName)
 	}
+	responseBodyText := string(responseBodyBytes)
 
 	log.Printf("responseBodyText: %s", responseBodyText)
 
 	if localResponse.StatusCode != 200 {
-		// TODO parse response body as JSON, expect:
-		writeVarnishCliResponse(writer, CLIS_OK, "Call for "+activityFriendlyName+" failed.")
 		log.Printf("Unexpected API response status: %d, body: %v", localResponse.StatusCode, responseBodyText)
-		return nil, fmt.Errorf("Unexpected HTTP status code: %d", localResponse.StatusCode)
+		return nil, fmt.Errorf("Call for %s failed with status %d.", activityFriendlyName, localResponse.StatusCode)
 	}
 
 	err = json.Unmarshal(responseBodyBytes, &result)
 	if err != nil {
 		log.Printf("Unable to decode JSON API response: %s", responseBodyText)
-		return nil, err
+		return nil, fmt.Errorf("Failed to decode the %s API response.", activityFriendlyName)
 	}
-	return
+	return result, nil
+}
+
+// dryRunResponseBody is the API response body assumed for requests not sent
+// in dry-run mode.
+const dryRunResponseBody = `{"success":true,"message":"Dry run, not sent to section.io."}`
+
+// sendApiRequest sends a request to the section.io API. In dry-run mode it
+// only logs the request and returns a successful response instead.
+func sendApiRequest(request *http.Request, dryRun bool) (*http.Response, error) {
+	if !dryRun {
+		return httpClient.Do(request)
+	}
+
+	requestBodyText := ""
+	if request.GetBody != nil {
+		requestBody, err := request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		requestBodyBytes, err := ioutil.ReadAll(requestBody)
+		if err != nil {
+			return nil, err
+		}
+		requestBodyText = string(requestBodyBytes)
+	}
+	log.Printf("Dry run, not sending %s %s with body: %s", request.Method, request.URL, requestBodyText)
+
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(dryRunResponseBody)),
+		Request:    request,
+	}, nil
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDryRunSendsNoApiRequests(t *testing.T) {
+	parseVclMessageTemplate("Update")
+
+	requestCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requestCount++
+	}))
+	defer server.Close()
+	listener := newTestListener("4.0", server.URL)
+
+	mockWriter := new(bytes.Buffer)
+	session := &varnishCliSession{Writer: mockWriter, Identity: "secret", Listener: listener}
+	handleVarnishCliBridgeDryRun("on", session)
+	if actual := mockWriter.String(); actual != "200 14      \nDry run is on.\n" {
+		t.Errorf("Unexpected response %#v.", actual)
+	}
+
+	mockWriter.Reset()
+	handleVarnishCliBanRequest(`req.url ~ "/"`, session)
+	if actual := mockWriter.String(); actual != "200 14      \nBan forwarded.\n" {
+		t.Errorf("Expected the ban to appear forwarded but was %#v.", actual)
+	}
+
+	listener.configs.add(vclConfig{Name: "boot", Source: "vcl 4.0;", Personality: "Varnish4"})
+	mockWriter.Reset()
+	handleVarnishCliVclUse("boot", session)
+	if actual := mockWriter.String(); !strings.HasPrefix(actual, "200 ") {
+		t.Errorf("Expected vcl.use to succeed but was %#v.", actual)
+	}
+
+	if requestCount != 0 {
+		t.Errorf("Expected no API requests but there were %d.", requestCount)
+	}
+	if deployments := listener.history.list(); len(deployments) != 0 {
+		t.Errorf("Expected no history for a dry run but was %#v.", deployments)
+	}
+	if active := listener.configs.active(); active != "boot" {
+		t.Errorf("Expected the config to become active in a dry run but was %#v.", active)
+	}
+}
+
+func TestDryRunReplacesActiveConfig(t *testing.T) {
+	defer func(previous string) { vclPersonality = previous }(vclPersonality)
+	vclPersonality = "Varnish4"
+	parseVclMessageTemplate("Update")
+	backend := &fakeBackend{}
+	listener := newTestListener("4.0")
+	listener.backend = backend
+	listener.configs.add(vclConfig{Name: "old", Source: "vcl 4.0;", Personality: "Varnish4"})
+	listener.configs.setActive("old")
+
+	mockWriter := new(bytes.Buffer)
+	session := &varnishCliSession{Writer: mockWriter, HasAuthenticated: true, DryRun: true, Listener: listener}
+	// as sent by clients replacing the VCL
+	for _, command := range []string{`vcl.inline new "vcl 4.0; # new"`, `vcl.use new`, `vcl.discard old`} {
+		mockWriter.Reset()
+		handleRequest(command, session)
+		if actual := mockWriter.String(); !strings.HasPrefix(actual, "200 ") {
+			t.Errorf("Expected %#v to succeed in a dry run but was %#v.", command, actual)
+		}
+	}
+	if backend.deployed != "" || len(listener.history.list()) != 0 {
+		t.Errorf("Expected nothing to be deployed or recorded but was %#v.", backend.deployed)
+	}
+}
+
+func TestGlobalDryRunCannotBeSwitchedOff(t *testing.T) {
+	defer func(previous bool) { dryRun = previous }(dryRun)
+	dryRun = true
+
+	mockWriter := new(bytes.Buffer)
+	session := &varnishCliSession{Writer: mockWriter, DryRun: true, Listener: newTestListener("4.0")}
+	handleVarnishCliBridgeDryRun("off", session)
+	if actual := mockWriter.String(); !strings.HasPrefix(actual, "300 ") || !session.DryRun {
+		t.Errorf("Expected switching off the global dry run to be refused but was %#v.", actual)
+	}
+
+	dryRun = false
+	mockWriter.Reset()
+	handleVarnishCliBridgeDryRun("off", session)
+	if actual := mockWriter.String(); actual != "200 15      \nDry run is off.\n" || session.DryRun {
+		t.Errorf("Expected a session dry run to be switched off but was %#v.", actual)
+	}
+}
+
+func TestVclUseReportsFailedApiCall(t *testing.T) {
+	parseVclMessageTemplate("Update")
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.WriteHeader(500)
+	}))
+	defer server.Close()
+	listener := newTestListener("4.0", server.URL)
+	listener.configs.add(vclConfig{Name: "boot", Source: "vcl 4.0;", Personality: "Varnish4"})
+
+	mockWriter := new(bytes.Buffer)
+	handleVarnishCliVclUse("boot", &varnishCliSession{Writer: mockWriter, Listener: listener})
+	expected := "300 53      \nCall for configuration update failed with status 500.\n"
+	if actual := mockWriter.String(); actual != expected {
+		t.Errorf("Expected %#v but was %#v.", expected, actual)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// invalidationBackend is what the bridge applies mutating CLI commands to.
+// The CLI protocol handling only deals with this interface, so that section.io
+// is one backend among others chosen by configuration.
+type invalidationBackend interface {
+	// Name identifies the kind of backend in logs and responses.
+	Name() string
+	ApplyBan(expression string, dryRun bool) backendResult
+	DeployVcl(request vclDeployRequest, dryRun bool) backendResult
+	// DeployedVcl returns the VCL currently in effect on the backend.
+	DeployedVcl() (string, error)
+	ListBans() (string, error)
+	Status() (string, error)
+}
+
+// vclDeployRequest is a VCL deployment passed to a backend. Previous is the
+// last deployment from the history, if any, for backends that revert a
+// partially failed deployment.
+type vclDeployRequest struct {
+	ConfigName  string
+	Personality string
+	Message     string
+	Content     string
+	Previous    *vclDeployment
+}
+
+// backendResult is the outcome of a mutating command on a backend. Summary is
+// added to the CLI response, and describes each target of a backend with
+// several. Response and Failures are recorded in the deployment history.
+type backendResult struct {
+	OK       bool
+	Summary  string
+	Response map[string]interface{}
+	Failures map[string]string
+}
+
+// errBackendUnsupported is returned by backends for operations they have no
+// equivalent of.
+var errBackendUnsupported = errors.New("not supported")
+
+const (
+	sectionioBackendName = "sectionio"
+	relayBackendName     = "relay"
+)
+
+var backendName = sectionioBackendName
+
+// newInvalidationBackend creates the backend named by a listener's
+// configuration.
+func newInvalidationBackend(listener *varnishCliListener) (invalidationBackend, error) {
+	switch listener.Backend {
+	case sectionioBackendName:
+		return newSectionioBackend(listener.ApiEndpoint)
+	case relayBackendName:
+		return newRelayBackend(listener)
+	}
+	return nil, fmt.Errorf("unknown backend '%s'.", listener.Backend)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// backendTargetResult is the outcome of a call to one target of a backend
+// with several, such as a section.io proxy or a relayed varnishd. Body
+// describes a success, when there is more to say than OK.
+type backendTargetResult struct {
+	Target   fmt.Stringer
+	Body     string
+	Response map[string]interface{}
+	Err      error
+}
+
+// callBackendTargets calls every target in parallel, returning the results in
+// the order of the targets.
+func callBackendTargets(targets []fmt.Stringer, call func(target fmt.Stringer) backendTargetResult) []backendTargetResult {
+	results := make([]backendTargetResult, len(targets))
+	var waitGroup sync.WaitGroup
+	for index, target := range targets {
+		waitGroup.Add(1)
+		go func(index int, target fmt.Stringer) {
+			defer waitGroup.Done()
+			result := call(target)
+			if result.Err != nil {
+				log.Printf("Request to %s failed: %v", target, result.Err)
+			}
+			result.Target = target
+			results[index] = result
+		}(index, target)
+	}
+	waitGroup.Wait()
+	return results
+}
+
+// backendTargetsSucceeded applies the partial failure policy to the results.
+func backendTargetsSucceeded(results []backendTargetResult) bool {
+	failures := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failures++
+		}
+	}
+	return failurePolicyAllows(failures, len(results))
+}
+
+// failurePolicyAllows applies the partial failure policy: every target must
+// succeed for all-or-nothing, at least one for best-effort.
+func failurePolicyAllows(failures int, targets int) bool {
+	if failures == 0 {
+		return true
+	}
+	return apiFailurePolicy == apiFailurePolicyBestEffort && failures < targets
+}
+
+// formatBackendTargetResults describes the outcome for each target, one per
+// line. With a single target only a failure needs describing.
+func formatBackendTargetResults(results []backendTargetResult) string {
+	if len(results) == 1 {
+		if results[0].Err != nil {
+			return results[0].Err.Error()
+		}
+		return ""
+	}
+	return formatBackendTargetLines(results)
+}
+
+// formatBackendTargetLines describes the outcome for each target, one per
+// line, with the body of each success.
+func formatBackendTargetLines(results []backendTargetResult) string {
+	var buffer bytes.Buffer
+	for _, result := range results {
+		switch {
+		case result.Err != nil:
+			fmt.Fprintf(&buffer, "%s: %v\n", result.Target, result.Err)
+		case result.Body != "":
+			fmt.Fprintf(&buffer, "%s: %s\n", result.Target, strings.TrimSpace(result.Body))
+		default:
+			fmt.Fprintf(&buffer, "%s: OK\n", result.Target)
+		}
+	}
+	return strings.TrimSuffix(buffer.String(), "\n")
+}
+
+// backendTargetStatus reports the status of every target, failing if any
+// target failed.
+func backendTargetStatus(results []backendTargetResult) (string, error) {
+	status := formatBackendTargetLines(results)
+	for _, result := range results {
+		if result.Err != nil {
+			return "", fmt.Errorf("%s", status)
+		}
+	}
+	return status, nil
+}
+
+// deployVclToBackendTargets deploys VCL to every target and applies the
+// partial failure policy. When the deployment fails under all-or-nothing the
+// targets which accepted it are reverted to the previous revision. The
+// Response of the first target which succeeded is the response of the result.
+func deployVclToBackendTargets(targets []fmt.Stringer, request vclDeployRequest, deploy func(target fmt.Stringer, request vclDeployRequest) backendTargetResult) backendResult {
+	results := callBackendTargets(targets, func(target fmt.Stringer) backendTargetResult {
+		return deploy(target, request)
+	})
+	result := backendResult{
+		OK:      backendTargetsSucceeded(results),
+		Summary: formatBackendTargetResults(results),
+	}
+
+	if !result.OK {
+		if apiFailurePolicy == apiFailurePolicyAllOrNothing {
+			result.Summary = joinResponseLines(result.Summary, revertBackendTargets(results, request, deploy))
+		}
+		return result
+	}
+
+	for _, targetResult := range results {
+		if targetResult.Err != nil {
+			if result.Failures == nil {
+				result.Failures = map[string]string{}
+			}
+			result.Failures[targetResult.Target.String()] = targetResult.Err.Error()
+		} else if result.Response == nil {
+			result.Response = targetResult.Response
+		}
+	}
+	return result
+}
+
+// revertBackendTargets deploys the previous revision again to the targets
+// which accepted a deployment that failed on others, so that all targets keep
+// the same VCL. It returns a description of the outcome.
+func revertBackendTargets(results []backendTargetResult, request vclDeployRequest, deploy func(target fmt.Stringer, request vclDeployRequest) backendTargetResult) string {
+	succeeded := []fmt.Stringer{}
+	for _, result := range results {
+		if result.Err == nil {
+			succeeded = append(succeeded, result.Target)
+		}
+	}
+	if len(succeeded) == 0 {
+		return ""
+	}
+	previous := request.Previous
+	if previous == nil {
+		log.Printf("No previous revision to revert VCL '%s' to on %d targets.", request.ConfigName, len(succeeded))
+		return "No previous revision known, targets that succeeded were not reverted."
+	}
+
+	revert := vclDeployRequest{
+		ConfigName:  previous.ConfigName,
+		Personality: previous.Personality,
+		Message:     fmt.Sprintf("Revert to revision %d after failed deployment of %s", previous.Revision, request.ConfigName),
+		Content:     previous.Content,
+	}
+	reverts := callBackendTargets(succeeded, func(target fmt.Stringer) backendTargetResult {
+		return deploy(target, revert)
+	})
+
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "Reverted to revision %d:", previous.Revision)
+	for _, result := range reverts {
+		if result.Err != nil {
+			fmt.Fprintf(&buffer, "\n%s: %v", result.Target, result.Err)
+		} else {
+			fmt.Fprintf(&buffer, "\n%s: OK", result.Target)
+		}
+	}
+	return buffer.String()
+}
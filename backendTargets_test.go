@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type testBackendTarget string
+
+func (target testBackendTarget) String() string {
+	return string(target)
+}
+
+func TestDeployVclToBackendTargetsRevertsUnderAllOrNothing(t *testing.T) {
+	defer func(previous string) { apiFailurePolicy = previous }(apiFailurePolicy)
+	targets := []fmt.Stringer{testBackendTarget("first"), testBackendTarget("second")}
+	deployed := map[string]string{}
+	deploy := func(target fmt.Stringer, request vclDeployRequest) backendTargetResult {
+		if target.String() == "second" {
+			return backendTargetResult{Err: errors.New("refused")}
+		}
+		deployed[target.String()] = request.Content
+		return backendTargetResult{Response: map[string]interface{}{"target": target.String()}}
+	}
+	request := vclDeployRequest{ConfigName: "new", Content: "vcl 4.0; # new", Previous: &vclDeployment{Revision: 3, Content: "vcl 4.0; # old"}}
+
+	apiFailurePolicy = apiFailurePolicyAllOrNothing
+	result := deployVclToBackendTargets(targets, request, deploy)
+	if result.OK || !strings.Contains(result.Summary, "second: refused") || !strings.Contains(result.Summary, "Reverted to revision 3:\nfirst: OK") {
+		t.Errorf("Expected the deployment to fail and be reverted but was %#v.", result)
+	}
+	if deployed["first"] != "vcl 4.0; # old" {
+		t.Errorf("Expected the first target to have the previous revision but was %#v.", deployed["first"])
+	}
+
+	apiFailurePolicy = apiFailurePolicyBestEffort
+	result = deployVclToBackendTargets(targets, request, deploy)
+	if !result.OK || result.Failures["second"] != "refused" || result.Response["target"] != "first" {
+		t.Errorf("Expected the deployment to succeed with a recorded failure but was %#v.", result)
+	}
+}
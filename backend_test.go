@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeBackend struct {
+	bans     []string
+	deploys  []vclDeployRequest
+	deployed string
+	// failures are reported by DeployVcl as targets which failed
+	failures map[string]string
+}
+
+func (backend *fakeBackend) Name() string {
+	return "fake"
+}
+
+func (backend *fakeBackend) ApplyBan(expression string, dryRun bool) backendResult {
+	backend.bans = append(backend.bans, expression)
+	return backendResult{OK: true}
+}
+
+func (backend *fakeBackend) DeployVcl(request vclDeployRequest, dryRun bool) backendResult {
+	backend.deploys = append(backend.deploys, request)
+	if !dryRun {
+		backend.deployed = request.Content
+	}
+	return backendResult{OK: true, Response: map[string]interface{}{"message": "ok"}, Failures: backend.failures}
+}
+
+func (backend *fakeBackend) DeployedVcl() (string, error) {
+	return backend.deployed, nil
+}
+
+func (backend *fakeBackend) ListBans() (string, error) {
+	return "1500000000.000000     0 -  req.url ~ /", nil
+}
+
+func (backend *fakeBackend) Status() (string, error) {
+	return "", nil
+}
+
+func TestCommandsUseListenerBackend(t *testing.T) {
+	parseVclMessageTemplate("Update")
+	backend := &fakeBackend{}
+	listener := newTestListener("4.0")
+	listener.backend = backend
+	listener.configs.add(vclConfig{Name: "first", Source: "vcl 4.0;", Personality: "Varnish4"})
+
+	mockWriter := new(bytes.Buffer)
+	session := &varnishCliSession{Writer: mockWriter, HasAuthenticated: true, Listener: listener}
+	handleRequest(`ban.url ^/images/`, session)
+	handleRequest(`vcl.use first`, session)
+	handleRequest(`ban.list`, session)
+	handleRequest(`status`, session)
+
+	if len(backend.bans) != 1 || backend.bans[0] != `"req.url" "~" "^/images/"` {
+		t.Errorf("Expected the ban to be applied by the backend but was %#v.", backend.bans)
+	}
+	if len(backend.deploys) != 1 || backend.deploys[0].ConfigName != "first" || backend.deploys[0].Previous != nil {
+		t.Errorf("Expected the VCL to be deployed by the backend but was %#v.", backend.deploys)
+	}
+	if _, ok := listener.history.latest(); !ok {
+		t.Errorf("Expected the deployment to be recorded.")
+	}
+	actual := mockWriter.String()
+	for _, expected := range []string{"Ban forwarded.", "Present bans:\n1500000000.000000", "Child in state running"} {
+		if !strings.Contains(actual, expected) {
+			t.Errorf("Expected the responses to contain %#v but were %#v.", expected, actual)
+		}
+	}
+}
+
+func TestSectionioBackendStatusAndBanList(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte(`{"content":"vcl 4.0;"}`))
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.WriteHeader(500)
+	}))
+	defer bad.Close()
+
+	mockWriter := new(bytes.Buffer)
+	session := &varnishCliSession{Writer: mockWriter, Listener: newTestListener("4.0", good.URL)}
+	handleVarnishCliStatus(session)
+	expected := "200 87      \nChild in state running\naccount/1/application/1/environment/Production/proxy/varnish: OK\n"
+	if actual := mockWriter.String(); actual != expected {
+		t.Errorf("Expected %#v but was %#v.", expected, actual)
+	}
+
+	mockWriter.Reset()
+	session.Listener = newTestListener("4.0", good.URL, bad.URL)
+	handleVarnishCliStatus(session)
+	if actual := mockWriter.String(); !strings.HasPrefix(actual, "300 ") || !strings.Contains(actual, "application/2/environment/Production/proxy/varnish: ") {
+		t.Errorf("Expected the failing target to be reported but was %#v.", actual)
+	}
+
+	mockWriter.Reset()
+	handleVarnishCliBanList(session)
+	if actual := mockWriter.String(); !strings.HasPrefix(actual, "300 ") || !strings.Contains(actual, "not supported by the sectionio backend") {
+		t.Errorf("Expected ban.list to be unsupported but was %#v.", actual)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+type diffLine struct {
+	Op       byte // ' ', '-' or '+'
+	Text     string
+	FromLine int // 1-based line number in the old text, for ' ' and '-'
+	ToLine   int // 1-based line number in the new text, for ' ' and '+'
+}
+
+func splitDiffLines(text string) []string {
+	if text == "" {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// maximumDiffCells limits the size of the table of common subsequence
+// lengths, the product of the line counts of the changed middle of the
+// texts, as the client controls the size of the VCL it diffs.
+const maximumDiffCells = 1 << 22
+
+// diffLines returns the edit script turning from into to, based on their
+// longest common subsequence of lines. Lines common to the start and end of
+// both are matched first, so that only the middle needs the table.
+func diffLines(from []string, to []string) ([]diffLine, error) {
+	prefix := 0
+	for prefix < len(from) && prefix < len(to) && from[prefix] == to[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(from)-prefix && suffix < len(to)-prefix && from[len(from)-1-suffix] == to[len(to)-1-suffix] {
+		suffix++
+	}
+	fromMiddle := from[prefix : len(from)-suffix]
+	toMiddle := to[prefix : len(to)-suffix]
+	if len(fromMiddle) > 0 && len(toMiddle) > maximumDiffCells/len(fromMiddle) {
+		return nil, fmt.Errorf("The texts differ in too many lines to compare, %d and %d.", len(fromMiddle), len(toMiddle))
+	}
+
+	// common[i*width+j] is the length of the longest common subsequence of
+	// fromMiddle[i:] and toMiddle[j:]
+	width := len(toMiddle) + 1
+	common := make([]int32, (len(fromMiddle)+1)*width)
+	for i := len(fromMiddle) - 1; i >= 0; i-- {
+		for j := len(toMiddle) - 1; j >= 0; j-- {
+			if fromMiddle[i] == toMiddle[j] {
+				common[i*width+j] = common[(i+1)*width+j+1] + 1
+			} else if common[(i+1)*width+j] >= common[i*width+j+1] {
+				common[i*width+j] = common[(i+1)*width+j]
+			} else {
+				common[i*width+j] = common[i*width+j+1]
+			}
+		}
+	}
+
+	lines := []diffLine{}
+	for index := 0; index < prefix; index++ {
+		lines = append(lines, diffLine{Op: ' ', Text: from[index], FromLine: index + 1, ToLine: index + 1})
+	}
+	i, j := 0, 0
+	for i < len(fromMiddle) || j < len(toMiddle) {
+		switch {
+		case i < len(fromMiddle) && j < len(toMiddle) && fromMiddle[i] == toMiddle[j]:
+			lines = append(lines, diffLine{Op: ' ', Text: fromMiddle[i], FromLine: prefix + i + 1, ToLine: prefix + j + 1})
+			i++
+			j++
+		case j >= len(toMiddle) || (i < len(fromMiddle) && common[(i+1)*width+j] >= common[i*width+j+1]):
+			lines = append(lines, diffLine{Op: '-', Text: fromMiddle[i], FromLine: prefix + i + 1, ToLine: prefix + j})
+			i++
+		default:
+			lines = append(lines, diffLine{Op: '+', Text: toMiddle[j], FromLine: prefix + i, ToLine: prefix + j + 1})
+			j++
+		}
+	}
+	for index := 0; index < suffix; index++ {
+		fromLine, toLine := len(from)-suffix+index, len(to)-suffix+index
+		lines = append(lines, diffLine{Op: ' ', Text: from[fromLine], FromLine: fromLine + 1, ToLine: toLine + 1})
+	}
+	return lines, nil
+}
+
+// unifiedDiff formats the differences between two texts like `diff -u`,
+// returning an empty string when they are identical.
+func unifiedDiff(fromName string, toName string, from string, to string, context int) (string, error) {
+	lines, err := diffLines(splitDiffLines(from), splitDiffLines(to))
+	if err != nil {
+		return "", err
+	}
+
+	var buffer bytes.Buffer
+	for start := 0; start < len(lines); {
+		// find the next change and the extent of its hunk
+		first := start
+		for first < len(lines) && lines[first].Op == ' ' {
+			first++
+		}
+		if first == len(lines) {
+			break
+		}
+		last := first
+		for next := first; next < len(lines); next++ {
+			if lines[next].Op != ' ' {
+				if next-last > 2*context {
+					break
+				}
+				last = next
+			}
+		}
+		hunkStart := first - context
+		if hunkStart < start {
+			hunkStart = start
+		}
+		hunkEnd := last + context + 1
+		if hunkEnd > len(lines) {
+			hunkEnd = len(lines)
+		}
+
+		if buffer.Len() == 0 {
+			fmt.Fprintf(&buffer, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		writeDiffHunk(&buffer, lines[hunkStart:hunkEnd])
+		start = hunkEnd
+	}
+	return buffer.String(), nil
+}
+
+func writeDiffHunk(buffer *bytes.Buffer, hunk []diffLine) {
+	fromStart, fromCount, toStart, toCount := 0, 0, 0, 0
+	for _, line := range hunk {
+		if line.Op != '+' {
+			if fromCount == 0 {
+				fromStart = line.FromLine
+			}
+			fromCount++
+		}
+		if line.Op != '-' {
+			if toCount == 0 {
+				toStart = line.ToLine
+			}
+			toCount++
+		}
+	}
+	// an empty range is given as the line before it, like diff does
+	if fromCount == 0 {
+		fromStart = hunk[0].FromLine
+	}
+	if toCount == 0 {
+		toStart = hunk[0].ToLine
+	}
+
+	fmt.Fprintf(buffer, "@@ -%s +%s @@\n", formatDiffRange(fromStart, fromCount), formatDiffRange(toStart, toCount))
+	for _, line := range hunk {
+		buffer.WriteByte(line.Op)
+		buffer.WriteString(line.Text)
+		buffer.WriteByte('\n')
+	}
+}
+
+func formatDiffRange(start int, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	from := "vcl 4.0;\n\nsub vcl_recv {\n    return (hash);\n}\n\nsub vcl_deliver {\n    unset resp.http.Via;\n}\n"
+	to := "vcl 4.0;\n\nsub vcl_recv {\n    if (req.url ~ \"^/admin\") {\n        return (pass);\n    }\n    return (hash);\n}\n\nsub vcl_deliver {\n}\n"
+
+	expected := `--- deployed
++++ boot
+@@ -1,9 +1,11 @@
+ vcl 4.0;
+ 
+ sub vcl_recv {
++    if (req.url ~ "^/admin") {
++        return (pass);
++    }
+     return (hash);
+ }
+ 
+ sub vcl_deliver {
+-    unset resp.http.Via;
+ }
+`
+	if actual, _ := unifiedDiff("deployed", "boot", from, to, 3); actual != expected {
+		t.Errorf("Expected diff %#v but was %#v.", expected, actual)
+	}
+}
+
+func TestUnifiedDiffSeparatesDistantHunks(t *testing.T) {
+	from := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+	to := "one\n2\n3\n4\n5\n6\n7\n8\n9\n"
+
+	expected := "--- a\n+++ b\n@@ -1,2 +1,2 @@\n-1\n+one\n 2\n@@ -9,2 +9 @@\n 9\n-10\n"
+	if actual, _ := unifiedDiff("a", "b", from, to, 1); actual != expected {
+		t.Errorf("Expected diff %#v but was %#v.", expected, actual)
+	}
+}
+
+func TestUnifiedDiffOfIdenticalTextIsEmpty(t *testing.T) {
+	if actual, _ := unifiedDiff("a", "b", "same\n", "same\n", 3); actual != "" {
+		t.Errorf("Expected no diff but was %#v.", actual)
+	}
+	if actual, _ := unifiedDiff("a", "b", "", "new\n", 3); actual != "--- a\n+++ b\n@@ -0,0 +1 @@\n+new\n" {
+		t.Errorf("Expected diff adding to an empty text but was %#v.", actual)
+	}
+}
+
+func TestUnifiedDiffLimitsChangedLines(t *testing.T) {
+	var from, to []string
+	for index := 0; index < 5000; index++ {
+		from = append(from, "old")
+		to = append(to, "new")
+	}
+	if _, err := unifiedDiff("a", "b", strings.Join(from, "\n"), strings.Join(to, "\n"), 3); err == nil {
+		t.Errorf("Expected texts differing in every line to be refused.")
+	}
+
+	// lines common to the start and end do not count towards the limit
+	to = append(append([]string{}, from[:4999]...), "new")
+	actual, err := unifiedDiff("a", "b", strings.Join(from, "\n"), strings.Join(to, "\n"), 1)
+	expected := "--- a\n+++ b\n@@ -4999,2 +4999,2 @@\n old\n-old\n+new\n"
+	if err != nil || actual != expected {
+		t.Errorf("Expected diff %#v but was %#v, %v.", expected, actual, err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
@@ -8,22 +9,97 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
-func getVarnishSecret() ([]byte, error) {
-	file, err := os.Open(secretFile)
+func getVarnishSecret(path string) ([]byte, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to open secret file '%s':\n%#v", secretFile, err)
+		return nil, fmt.Errorf("Failed to open secret file '%s':\n%#v", path, err)
 	}
 	defer file.Close()
 	secretBytes, err := ioutil.ReadAll(file)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to read secret file '%s':\n%#v", secretFile, err)
+		return nil, fmt.Errorf("Failed to read secret file '%s':\n%#v", path, err)
 	}
 	return secretBytes, nil
 }
 
+// approverSecret is a secret file with which clients authenticate as
+// approvers, and the identity recorded for them.
+type approverSecret struct {
+	Identity string
+	Path     string
+}
+
+var approverSecrets []approverSecret
+
+// parseApproverSecrets parses a comma-separated list of approver secret files,
+// each optionally preceded by its identity and '='. The identity defaults to
+// the path of the file.
+func parseApproverSecrets(spec string) ([]approverSecret, error) {
+	secrets := []approverSecret{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		secret := approverSecret{Identity: entry, Path: entry}
+		if index := strings.Index(entry, "="); index >= 0 {
+			secret.Identity = entry[:index]
+			secret.Path = entry[index+1:]
+		}
+		if secret.Identity == "" || secret.Path == "" {
+			return nil, fmt.Errorf("Approver secret '%s' needs an identity and a file.", entry)
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
+
+// checkApproverSecrets refuses approver secrets which are not distinct from
+// each other and from the secret files of the listeners, by path, content and
+// identity, as approval must come from someone other than the requester.
+func checkApproverSecrets(secrets []approverSecret, listeners []*varnishCliListener) error {
+	type credential struct {
+		description string
+		identity    string
+		path        string
+	}
+	credentials := []credential{}
+	for _, listener := range listeners {
+		if listener.SecretFile != "" {
+			credentials = append(credentials, credential{fmt.Sprintf("the secret file of listener '%s'", listener.Name), listener.secretIdentity(), listener.SecretFile})
+		}
+	}
+	for _, secret := range secrets {
+		credentials = append(credentials, credential{fmt.Sprintf("approver secret file '%s'", secret.Path), secret.Identity, secret.Path})
+	}
+
+	contents := make([][]byte, len(credentials))
+	for index, credential := range credentials {
+		secretBytes, err := getVarnishSecret(credential.path)
+		if err != nil {
+			return err
+		}
+		contents[index] = secretBytes
+	}
+	for index := len(credentials) - len(secrets); index < len(credentials); index++ {
+		for other := 0; other < index; other++ {
+			switch {
+			case filepath.Clean(credentials[index].path) == filepath.Clean(credentials[other].path):
+				return fmt.Errorf("The %s is also %s.", credentials[index].description, credentials[other].description)
+			case bytes.Equal(contents[index], contents[other]):
+				return fmt.Errorf("The %s has the same secret as %s.", credentials[index].description, credentials[other].description)
+			case credentials[index].identity == credentials[other].identity:
+				return fmt.Errorf("The %s has the same identity '%s' as %s.", credentials[index].description, credentials[index].identity, credentials[other].description)
+			}
+		}
+	}
+	return nil
+}
+
 func writeVarnishCliAuthenticationChallenge(session *varnishCliSession) {
 	const challengeSize = 32
 
@@ -42,7 +118,23 @@ func writeVarnishCliAuthenticationChallenge(session *varnishCliSession) {
 }
 
 func handleVarnishCliAuthenticationAttempt(args string, session *varnishCliSession) {
-	secretBytes, err := getVarnishSecret()
+	for _, secret := range approverSecrets {
+		if len(session.AuthChallenge) == 0 {
+			break
+		}
+		approverSecretBytes, err := getVarnishSecret(secret.Path)
+		if err != nil {
+			log.Printf("Cannot get approver secret: %#v", err)
+		} else if strings.ToLower(args) == computeVarnishAuthenticator(session.AuthChallenge, approverSecretBytes) {
+			session.HasAuthenticated = true
+			session.IsApprover = true
+			session.Identity = secret.Identity
+			writeVarnishCliBanner(session)
+			return
+		}
+	}
+
+	secretBytes, err := getVarnishSecret(session.Listener.SecretFile)
 	if err != nil {
 		log.Printf("Cannot get secret: %#v", err)
 		writeVarnishCliResponse(session.Writer, CLIS_CANT, "Secret not available.")
@@ -58,20 +150,26 @@ func handleVarnishCliAuthenticationAttemptInternal(args string, session *varnish
 		return
 	}
 
-	hash := sha256.New()
-	hash.Write([]byte(session.AuthChallenge + "\n"))
-	hash.Write(secretBytes)
-	hash.Write([]byte(session.AuthChallenge + "\n"))
-
-	expectedAuthResponse := hex.EncodeToString(hash.Sum(nil))
+	expectedAuthResponse := computeVarnishAuthenticator(session.AuthChallenge, secretBytes)
 	log.Printf("expectedAuthResponse: %s", expectedAuthResponse)
 
 	// TODO allow whitespace-trimmed and case-insensitive compare of hex
 	if strings.ToLower(args) == expectedAuthResponse {
 		session.HasAuthenticated = true
-		writeVarnishCliBanner(session.Writer)
+		session.Identity = session.Listener.secretIdentity()
+		writeVarnishCliBanner(session)
 	} else {
 		log.Print("Failed to authenticate")
 		writeVarnishCliAuthenticationChallenge(session)
 	}
 }
+
+// computeVarnishAuthenticator returns the response varnishd expects to a
+// challenge, as described in varnish-cli(7).
+func computeVarnishAuthenticator(challenge string, secretBytes []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(challenge + "\n"))
+	hash.Write(secretBytes)
+	hash.Write([]byte(challenge + "\n"))
+	return hex.EncodeToString(hash.Sum(nil))
+}
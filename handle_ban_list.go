@@ -0,0 +1,19 @@
+package main
+
+func handleVarnishCliBanList(session *varnishCliSession) {
+	bans, err := session.Listener.backend.ListBans()
+	if err == errBackendUnsupported && session.Listener.upstream != nil {
+		handleVarnishCliPassthrough("ban.list", session)
+		return
+	}
+	if err == errBackendUnsupported {
+		writeVarnishCliResponse(session.Writer, CLIS_CANT,
+			"Listing bans is not supported by the "+session.Listener.backend.Name()+" backend.")
+		return
+	}
+	if err != nil {
+		writeVarnishCliResponse(session.Writer, CLIS_CANT, err.Error())
+		return
+	}
+	writeVarnishCliResponse(session.Writer, CLIS_OK, "Present bans:\n"+bans)
+}
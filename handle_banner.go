@@ -2,10 +2,9 @@ package main
 
 import (
 	"fmt"
-	"io"
 )
 
-func writeVarnishCliBanner(writer io.Writer) {
+func writeVarnishCliBanner(session *varnishCliSession) {
 	// emulate the normal banner Varnish for client-compatibility.
 	bannerFormat := `-----------------------------
 Varnish Cache CLI Bridge
@@ -16,5 +15,5 @@ https://github.com/section-io/varnish-cli-bridge
 Type 'help' for command list.
 Type 'quit' to close CLI session.`
 
-	writeVarnishCliResponse(writer, CLIS_OK, fmt.Sprintf(bannerFormat, bannerVarnishVersion))
+	writeVarnishCliResponse(session.Writer, CLIS_OK, fmt.Sprintf(bannerFormat, session.Listener.BannerVersion))
 }
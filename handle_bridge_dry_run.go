@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// handleVarnishCliBridgeDryRun is an extension command switching dry-run mode
+// on or off for the session, or reporting it when no argument is given. When
+// dry-run mode is on for the whole bridge a session cannot switch it off.
+func handleVarnishCliBridgeDryRun(arg string, session *varnishCliSession) {
+	switch arg {
+	case "":
+	case "on":
+		session.DryRun = true
+	case "off":
+		if dryRun {
+			writeVarnishCliResponse(session.Writer, CLIS_CANT, "Dry run is on for the bridge and cannot be switched off.")
+			return
+		}
+		session.DryRun = false
+	default:
+		writeVarnishCliResponse(session.Writer, CLIS_PARAM, fmt.Sprintf("Dry run must be on or off but was \"%s\".", arg))
+		return
+	}
+	if arg != "" {
+		log.Printf("Dry run switched %s for session from %s.", arg, session.RemoteAddress)
+	}
+
+	state := "off"
+	if session.DryRun {
+		state = "on"
+	}
+	writeVarnishCliResponse(session.Writer, CLIS_OK, fmt.Sprintf("Dry run is %s.", state))
+}
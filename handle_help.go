@@ -2,10 +2,21 @@ package main
 
 import (
 	"fmt"
-	"io"
 )
 
-func handleVarnishCliHelpRequest(arg string, writer io.Writer) {
+// handleVarnishCliHelpRequest lists the commands available with the Varnish
+// version of the listener.
+func handleVarnishCliHelpRequest(arg string, session *varnishCliSession) {
+	writer := session.Writer
+
+	vclStateHelp := ""
+	if session.Listener.varnishVersionAtLeast(4, 1) {
+		vclStateHelp = "vcl.state <configname> <state>\n"
+	}
+	vclLabelHelp := ""
+	if session.Listener.varnishVersionAtLeast(5, 0) {
+		vclLabelHelp = "vcl.label <label> <configname>\n"
+	}
 
 	if arg == "" {
 		writeVarnishCliResponse(writer, CLIS_OK, `help [command]
@@ -15,20 +26,27 @@ auth response
 			quit
 			*/
 			`banner
+status
 `+ /*
-			status
 			start
 			stop
-			vcl.load <configname> <filename>
 			*/
-			`vcl.inline <configname> <quoted_VCLstring>
+			`vcl.load <configname> <filename>
+vcl.inline <configname> <quoted_VCLstring>
 vcl.use <configname>
-`+ /*
-			vcl.discard <configname>
-			vcl.list
-			vcl.show <configname>
-			*/
-			`param.show [-l] [<param>]
+vcl.list [-j]
+vcl.show [-v] <configname>
+vcl.discard <configname>
+`+vclStateHelp+vclLabelHelp+`vcl.preview <configname>
+vcl.diff <configname>
+vcl.history
+vcl.rollback <revision>
+vcl.pending
+vcl.approve <reference>
+vcl.reject <reference>
+bridge.dry_run [on|off]
+relay.targets
+param.show [-l] [<param>]
 `+ /*
 			param.set <param> <value>
 			panic.show
@@ -39,10 +57,9 @@ vcl.use <configname>
 			*/
 			`ban.url <regexp>
 ban <field> <operator> <arg> [&& <field> <oper> <arg>]...
-`+ /*
-			ban.list
-			*/
-			``)
+ban.list
+purge.keys <key> [<key>]...
+`)
 		return
 	}
 
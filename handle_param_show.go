@@ -2,10 +2,10 @@ package main
 
 import (
 	"fmt"
-	"io"
 )
 
-func handleVarnishCliParamShowRequest(arg string, writer io.Writer) {
+func handleVarnishCliParamShowRequest(arg string, session *varnishCliSession) {
+	writer := session.Writer
 	switch arg {
 	case "esi_syntax":
 		writeVarnishCliResponse(writer, CLIS_OK, `esi_syntax                  2 [bitmap]
@@ -26,7 +26,7 @@ func handleVarnishCliParamShowRequest(arg string, writer io.Writer) {
 `)
 
 	case `cli_buffer`:
-		if varnishVersion == "4.0" || varnishVersion == "4.1" {
+		if session.Listener.varnishVersionAtLeast(4, 0) {
 			writeVarnishCliResponse(writer, CLIS_OK, `cli_buffer
         Value is: 32k [bytes]
         Default is: 8k
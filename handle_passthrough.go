@@ -0,0 +1,43 @@
+package main
+
+import "log"
+
+// readOnlyPassthroughCommands change nothing on the upstream varnishd, so
+// they are passed through in dry run too.
+var readOnlyPassthroughCommands = map[string]bool{
+	"backend.list": true,
+	"ban.list":     true,
+	"banner":       true,
+	"help":         true,
+	"panic.show":   true,
+	"param.show":   true,
+	"ping":         true,
+	"status":       true,
+	"storage.list": true,
+	"vcl.list":     true,
+	"vcl.show":     true,
+}
+
+// handleVarnishCliPassthrough forwards a command the bridge does not handle to
+// the upstream varnishd of the listener, relaying its response unchanged.
+func handleVarnishCliPassthrough(requestLine string, session *varnishCliSession) {
+	upstream := session.Listener.upstream
+	if session.DryRun && !isReadOnlyPassthrough(requestLine) {
+		log.Printf("Dry run, not passing through to '%s': %s", upstream.Address, requestLine)
+		writeVarnishCliResponse(session.Writer, CLIS_OK, "Dry run, not passed through to the upstream varnishd.")
+		return
+	}
+
+	status, body, err := upstream.call(requestLine)
+	if err != nil {
+		log.Printf("Passing '%s' through to '%s' failed: %v", requestLine, upstream.Address, err)
+		writeVarnishCliResponse(session.Writer, CLIS_COMMS, "Failed to pass the command through to the upstream varnishd.")
+		return
+	}
+	writeVarnishCliResponse(session.Writer, status, body)
+}
+
+func isReadOnlyPassthrough(requestLine string) bool {
+	commandAndArgs := tokenizeRequest(requestLine)
+	return len(commandAndArgs) > 0 && readOnlyPassthroughCommands[commandAndArgs[0]]
+}
@@ -0,0 +1,8 @@
+package main
+
+// handleVarnishCliPurgeKeys is an extension command banning objects tagged
+// with any of the given surrogate keys.
+func handleVarnishCliPurgeKeys(keys []string, session *varnishCliSession) {
+	status, response := purgeKeys(keys, session)
+	writeVarnishCliResponse(session.Writer, status, response)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// handleVarnishCliRelayTargets is an extension command listing the varnishd
+// instances the relay backend currently sends to, with where each came from
+// and how many connections to it are open.
+func handleVarnishCliRelayTargets(session *varnishCliSession) {
+	backend, ok := session.Listener.backend.(*relayBackend)
+	if !ok {
+		writeVarnishCliResponse(session.Writer, CLIS_CANT,
+			"The "+session.Listener.backend.Name()+" backend has no relay targets.")
+		return
+	}
+
+	backend.mutex.Lock()
+	targets := backend.targets
+	backend.mutex.Unlock()
+
+	var buffer bytes.Buffer
+	for _, target := range targets {
+		fmt.Fprintf(&buffer, "%-30s %2d  %s\n", target.Address, target.idleCount(), target.Source)
+	}
+	writeVarnishCliResponse(session.Writer, CLIS_OK, buffer.String())
+}
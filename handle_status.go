@@ -0,0 +1,16 @@
+package main
+
+// handleVarnishCliStatus answers as varnishd does with a running child,
+// followed by the status the backend reports for its targets.
+func handleVarnishCliStatus(session *varnishCliSession) {
+	status, err := session.Listener.backend.Status()
+	if err == errBackendUnsupported && session.Listener.upstream != nil {
+		handleVarnishCliPassthrough("status", session)
+		return
+	}
+	if err != nil {
+		writeVarnishCliResponse(session.Writer, CLIS_CANT, err.Error())
+		return
+	}
+	writeVarnishCliResponse(session.Writer, CLIS_OK, joinResponseLines("Child in state running", status))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+)
+
+// handleVarnishCliVclPending is an extension command listing the deployments
+// waiting for approval on the listener, oldest first.
+func handleVarnishCliVclPending(session *varnishCliSession) {
+	var buffer bytes.Buffer
+	for _, deployment := range session.Listener.approvals.list() {
+		fmt.Fprintf(&buffer, "%-16s %s %-20s %s\n",
+			deployment.ID,
+			deployment.Expires.Format(time.RFC3339),
+			deployment.Identity,
+			deployment.ConfigName)
+	}
+	writeVarnishCliResponse(session.Writer, CLIS_OK, buffer.String())
+}
+
+// checkVclApprover writes the CLI response and returns false unless the
+// session may approve or reject the pending deployment with the given ID.
+func checkVclApprover(id string, session *varnishCliSession) (pendingVclDeployment, bool) {
+	if !session.IsApprover {
+		writeVarnishCliResponse(session.Writer, CLIS_CANT, "Only an approver may approve or reject VCL deployments.")
+		return pendingVclDeployment{}, false
+	}
+	deployment, ok := session.Listener.approvals.get(id)
+	if !ok {
+		writeVarnishCliResponse(session.Writer, CLIS_PARAM, fmt.Sprintf("No pending VCL deployment %s known.", id))
+		return pendingVclDeployment{}, false
+	}
+	if deployment.Identity == session.Identity {
+		writeVarnishCliResponse(session.Writer, CLIS_CANT, "A VCL deployment must be approved by someone other than the requester.")
+		return pendingVclDeployment{}, false
+	}
+	return deployment, true
+}
+
+// handleVarnishCliVclApprove is an extension command deploying a pending
+// VCL deployment to section.io on behalf of the client that requested it.
+func handleVarnishCliVclApprove(id string, session *varnishCliSession) {
+	deployment, ok := checkVclApprover(id, session)
+	if !ok {
+		return
+	}
+	if !session.Listener.approvals.remove(id) {
+		writeVarnishCliResponse(session.Writer, CLIS_PARAM, fmt.Sprintf("No pending VCL deployment %s known.", id))
+		return
+	}
+
+	requester := &varnishCliSession{
+		Writer:        session.Writer,
+		Identity:      deployment.Identity,
+		RemoteAddress: deployment.ClientAddress,
+		DryRun:        deployment.DryRun,
+		Listener:      session.Listener,
+	}
+	summary, ok := deployVcl(requester, deployment.ConfigName, deployment.Personality, deployment.Content, session.Identity)
+	if !ok {
+		return
+	}
+	if _, ok := session.Listener.configs.get(deployment.ConfigName); ok {
+		if err := session.Listener.configs.setActive(deployment.ConfigName); err != nil {
+			writeVarnishCliResponse(session.Writer, CLIS_CANT, joinResponseLines(summary, err.Error()))
+			return
+		}
+	}
+	log.Printf("Deployment %s of VCL '%s' approved by %s.", id, deployment.ConfigName, session.Identity)
+	writeVarnishCliResponse(session.Writer, CLIS_OK, joinResponseLines(fmt.Sprintf("Deployment %s of VCL '%s' approved.", id, deployment.ConfigName), summary))
+}
+
+// handleVarnishCliVclReject is an extension command discarding a pending VCL
+// deployment.
+func handleVarnishCliVclReject(id string, session *varnishCliSession) {
+	deployment, ok := checkVclApprover(id, session)
+	if !ok {
+		return
+	}
+	if !session.Listener.approvals.remove(id) {
+		writeVarnishCliResponse(session.Writer, CLIS_PARAM, fmt.Sprintf("No pending VCL deployment %s known.", id))
+		return
+	}
+	log.Printf("Deployment %s of VCL '%s' rejected by %s.", id, deployment.ConfigName, session.Identity)
+	writeVarnishCliResponse(session.Writer, CLIS_OK, fmt.Sprintf("Deployment %s of VCL '%s' rejected.", id, deployment.ConfigName))
+}
@@ -0,0 +1,35 @@
+package main
+
+import "fmt"
+
+// handleVarnishCliVclDiff is an extension command returning a unified diff
+// from the VCL deployed on section.io to what vcl.use would deploy for a
+// config.
+func handleVarnishCliVclDiff(configname string, session *varnishCliSession) {
+	writer := session.Writer
+
+	config, ok := session.Listener.configs.resolve(configname)
+	if !ok {
+		writeVarnishCliResponse(writer, CLIS_PARAM, fmt.Sprintf(`No configuration named %s known.`, configname))
+		return
+	}
+
+	content, err := transformVcl(config.Source)
+	if err != nil {
+		writeVarnishCliResponse(writer, CLIS_CANT, err.Error())
+		return
+	}
+
+	deployed, err := fetchDeployedVcl(session)
+	if err != nil {
+		//CLI Response already written on non-200 or other error
+		return
+	}
+
+	diff, err := unifiedDiff("deployed", config.Name, deployed, content, 3)
+	if err != nil {
+		writeVarnishCliResponse(writer, CLIS_CANT, err.Error())
+		return
+	}
+	writeVarnishCliResponse(writer, CLIS_OK, diff)
+}
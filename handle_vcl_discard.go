@@ -0,0 +1,10 @@
+package main
+
+func handleVarnishCliVclDiscard(configname string, session *varnishCliSession) {
+	err := session.Listener.configs.discard(configname)
+	if err != nil {
+		writeVarnishCliResponse(session.Writer, CLIS_PARAM, err.Error())
+		return
+	}
+	writeVarnishCliResponse(session.Writer, CLIS_OK, ``)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// handleVarnishCliVclHistory is an extension command listing the VCL
+// deployments recorded by the bridge, most recent last.
+func handleVarnishCliVclHistory(session *varnishCliSession) {
+	var buffer bytes.Buffer
+	for _, deployment := range session.Listener.history.list() {
+		fmt.Fprintf(&buffer, "%-6d %s %.12s %-20s %s\n",
+			deployment.Revision,
+			deployment.Time.Format(time.RFC3339),
+			deployment.ContentHash,
+			deployment.Identity,
+			deployment.ConfigName)
+	}
+	writeVarnishCliResponse(session.Writer, CLIS_OK, buffer.String())
+}
+
+// handleVarnishCliVclRollback is an extension command deploying the content
+// of an earlier revision from the history again.
+func handleVarnishCliVclRollback(revisionArg string, session *varnishCliSession) {
+	revision, err := strconv.Atoi(revisionArg)
+	if err != nil {
+		writeVarnishCliResponse(session.Writer, CLIS_PARAM, fmt.Sprintf("Revision must be a number but was \"%s\".", revisionArg))
+		return
+	}
+
+	deployment, ok := session.Listener.history.get(revision)
+	if !ok {
+		writeVarnishCliResponse(session.Writer, CLIS_PARAM, fmt.Sprintf("No VCL revision %d known.", revision))
+		return
+	}
+
+	if vclApprovalRequired() {
+		queueVclDeployment(session, deployment.ConfigName, deployment.Personality, deployment.Content, "")
+		return
+	}
+
+	summary, ok := deployVcl(session, deployment.ConfigName, deployment.Personality, deployment.Content, "")
+	if !ok {
+		return
+	}
+	if _, ok := session.Listener.configs.get(deployment.ConfigName); ok {
+		if err := session.Listener.configs.setActive(deployment.ConfigName); err != nil {
+			writeVarnishCliResponse(session.Writer, CLIS_CANT, joinResponseLines(summary, err.Error()))
+			return
+		}
+	}
+	writeVarnishCliResponse(session.Writer, CLIS_OK, joinResponseLines(fmt.Sprintf("Rolled back to revision %d.", revision), summary))
+}
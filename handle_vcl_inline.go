@@ -1,12 +1,71 @@
 package main
 
-import "io"
+import "log"
 
-var inlineConfigName string
-var inlineQuotedVCLstring string
+// vclInlineSourceName is the source name varnishd gives VCL from vcl.inline.
+const vclInlineSourceName = "<vcl.inline>"
 
-func handleVarnishCliVclInline(configname string, quotedVCLstring string, writer io.Writer) {
-	inlineConfigName = configname
-	inlineQuotedVCLstring = quotedVCLstring
-	writeVarnishCliResponse(writer, CLIS_OK, `VCL.compiled`)
+func handleVarnishCliVclInline(configname string, quotedVCLstring string, state string, session *varnishCliSession) {
+	registerVclConfig(vclConfig{
+		Name:       configname,
+		SourceName: vclInlineSourceName,
+		Source:     quotedVCLstring,
+		State:      state,
+	}, session)
+}
+
+// registerVclConfig adds a config received via vcl.inline or vcl.load to the
+// registry and writes the CLI response.
+func registerVclConfig(config vclConfig, session *varnishCliSession) {
+	writer := session.Writer
+
+	if vclDirectory != "" {
+		path := ""
+		if config.SourceName != vclInlineSourceName {
+			path = config.SourceName
+		}
+		flattened, included, err := flattenVclIncludes(config.Source, path)
+		if err != nil {
+			log.Printf("VCL config '%s' include resolution failed: %v", config.Name, err)
+			writeVarnishCliResponse(writer, CLIS_PARAM, err.Error())
+			return
+		}
+		config.Source = flattened
+		config.Includes = included
+	}
+
+	program, syntaxError := parseVcl(config.Source, session.Listener.vclGrammarVersion())
+	if syntaxError != nil {
+		log.Printf("VCL config '%s' failed the syntax check: %v", config.Name, syntaxError)
+		writeVarnishCliResponse(writer, CLIS_PARAM, formatVccError(config.Source, config.SourceName, syntaxError))
+		return
+	}
+
+	program.Includes = config.Includes
+
+	response := `VCL.compiled`
+	violations, refused := checkVclPolicy(config.Source, program)
+	if len(violations) > 0 {
+		policyMessage := formatVclPolicyViolations(violations, refused)
+		log.Printf("VCL config '%s' policy check:\n%s", config.Name, policyMessage)
+		if refused {
+			writeVarnishCliResponse(writer, CLIS_PARAM, policyMessage)
+			return
+		}
+		response += "\n" + policyMessage
+	}
+
+	config.Personality = detectVclPersonality(config.Source)
+	if config.Personality == "" {
+		log.Printf("No personality matches VCL config '%s', vcl.use will refuse it.", config.Name)
+	} else {
+		log.Printf("Using personality '%s' for VCL config '%s'.", config.Personality, config.Name)
+	}
+
+	err := session.Listener.configs.add(config)
+	if err != nil {
+		writeVarnishCliResponse(writer, CLIS_PARAM, err.Error())
+		return
+	}
+	writeVarnishCliResponse(writer, CLIS_OK, response)
 }
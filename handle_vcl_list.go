@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+type jsonVclListEntry struct {
+	Status      string `json:"status"`
+	State       string `json:"state,omitempty"`
+	Temperature string `json:"temperature,omitempty"`
+	Busy        int    `json:"busy"`
+	Name        string `json:"name"`
+	Label       string `json:"label,omitempty"`
+}
+
+func handleVarnishCliVclList(args []string, session *varnishCliSession) {
+	writer := session.Writer
+
+	jsonOutput := false
+	for _, arg := range args {
+		if arg != "-j" {
+			writeVarnishCliResponse(writer, CLIS_PARAM, fmt.Sprintf("Unknown parameter \"%s\".", arg))
+			return
+		}
+		jsonOutput = true
+	}
+
+	configs, labels, activeName := session.Listener.configs.list()
+
+	entries := make([]jsonVclListEntry, 0, len(configs)+len(labels))
+	for _, config := range configs {
+		entry := jsonVclListEntry{Status: "available", Name: config.Name}
+		if config.Name == activeName {
+			entry.Status = "active"
+		}
+		if session.Listener.varnishVersionAtLeast(4, 1) {
+			entry.State = config.State
+			entry.Temperature = config.temperature(activeName)
+		}
+		entries = append(entries, entry)
+	}
+	for _, label := range labels {
+		entries = append(entries, jsonVclListEntry{
+			Status:      "available",
+			State:       "label",
+			Temperature: vclStateWarm,
+			Name:        label.Name,
+			Label:       label.Target,
+		})
+	}
+
+	if jsonOutput {
+		writeVclListJSON(entries, writer)
+		return
+	}
+
+	var buffer bytes.Buffer
+	for _, entry := range entries {
+		name := entry.Name
+		if entry.Label != "" {
+			name += " -> " + entry.Label
+		}
+		// column layout matches varnishd's ccf_config_list
+		if session.Listener.varnishVersionAtLeast(4, 1) {
+			fmt.Fprintf(&buffer, "%-10s %4s/%-8s %6d %s\n", entry.Status, entry.State, entry.Temperature, entry.Busy, name)
+		} else {
+			fmt.Fprintf(&buffer, "%-10s %6d %s\n", entry.Status, entry.Busy, name)
+		}
+	}
+	writeVarnishCliResponse(writer, CLIS_OK, buffer.String())
+}
+
+func writeVclListJSON(entries []jsonVclListEntry, writer io.Writer) {
+	// varnishd's JSON responses are an array of the format version, the
+	// command line, a timestamp and then one object per result.
+	response := []interface{}{
+		2,
+		[]string{"vcl.list", "-j"},
+		float64(time.Now().UnixNano()/int64(time.Millisecond)) / 1000,
+	}
+	for _, entry := range entries {
+		response = append(response, entry)
+	}
+
+	responseBytes, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		log.Printf("Error serialising vcl.list response to JSON: %v", err)
+		writeVarnishCliResponse(writer, CLIS_CANT, "Failed to serialise the VCL list.")
+		return
+	}
+	writeVarnishCliResponse(writer, CLIS_OK, string(responseBytes))
+}
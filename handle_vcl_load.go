@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+func handleVarnishCliVclLoad(configname string, filename string, state string, session *varnishCliSession) {
+	writer := session.Writer
+
+	if vclDirectory == "" {
+		writeVarnishCliResponse(writer, CLIS_CANT, "vcl.load is disabled because no VCL directory is configured.")
+		return
+	}
+
+	path, err := resolveVclPath(filename)
+	if err != nil {
+		log.Printf("Refusing vcl.load of '%s': %v", filename, err)
+		writeVarnishCliResponse(writer, CLIS_PARAM, fmt.Sprintf("Cannot open '%s'", filename))
+		return
+	}
+
+	sourceBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("Error reading VCL file '%s': %v", path, err)
+		writeVarnishCliResponse(writer, CLIS_PARAM, fmt.Sprintf("Cannot read '%s'", filename))
+		return
+	}
+
+	registerVclConfig(vclConfig{
+		Name:       configname,
+		SourceName: path,
+		Source:     string(sourceBytes),
+		State:      state,
+	}, session)
+}
+
+// resolveVclPath returns the real path of filename, relative to the VCL
+// directory unless absolute, refusing any path that resolves outside it.
+func resolveVclPath(filename string) (string, error) {
+	directory, err := filepath.Abs(vclDirectory)
+	if err != nil {
+		return "", err
+	}
+	directory, err = filepath.EvalSymlinks(directory)
+	if err != nil {
+		return "", err
+	}
+
+	path := filename
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(directory, path)
+	}
+	path, err = filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	relative, err := filepath.Rel(directory, path)
+	if err != nil {
+		return "", err
+	}
+	if relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Path '%s' is outside the VCL directory '%s'", path, directory)
+	}
+	return path, nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import "fmt"
+
+// handleVarnishCliVclPreview is an extension command returning the VCL that
+// vcl.use would deploy for a config, after the transform pipeline.
+func handleVarnishCliVclPreview(configname string, session *varnishCliSession) {
+	writer := session.Writer
+
+	config, ok := session.Listener.configs.resolve(configname)
+	if !ok {
+		writeVarnishCliResponse(writer, CLIS_PARAM, fmt.Sprintf(`No configuration named %s known.`, configname))
+		return
+	}
+
+	content, err := transformVcl(config.Source)
+	if err != nil {
+		writeVarnishCliResponse(writer, CLIS_CANT, err.Error())
+		return
+	}
+	writeVarnishCliResponse(writer, CLIS_OK, content)
+}
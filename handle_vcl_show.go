@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+)
+
+func handleVarnishCliVclShow(args []string, session *varnishCliSession) {
+	writer := session.Writer
+	configs := session.Listener.configs
+
+	verbose := false
+	if len(args) > 0 && args[0] == "-v" && session.Listener.varnishVersionAtLeast(4, 1) {
+		verbose = true
+		args = args[1:]
+	}
+	if len(args) < 1 {
+		writeVarnishCliResponse(writer, CLIS_TOOFEW, "Too few parameters")
+		return
+	}
+	if len(args) > 1 {
+		writeVarnishCliResponse(writer, CLIS_TOOMANY, "Too many parameters")
+		return
+	}
+	configname := args[0]
+
+	config, ok := configs.resolve(configname)
+	if !ok {
+		writeVarnishCliResponse(writer, CLIS_PARAM, fmt.Sprintf(`No configuration named %s known.`, configname))
+		return
+	}
+
+	source := config.Source
+	if vclShowDeployed && config.Name == configs.active() {
+		deployed, err := fetchDeployedVcl(session)
+		if err != nil {
+			//CLI Response already written on non-200 or other error
+			return
+		}
+		source = deployed
+	}
+
+	if verbose {
+		// varnishd prefixes each source file with a marker giving its index, length and name
+		writeVarnishCliResponse(writer, CLIS_OK,
+			fmt.Sprintf("// VCL.SHOW %d %d %s\n%s", 0, len(source), config.SourceName, source))
+		return
+	}
+	writeVarnishCliResponse(writer, CLIS_OK, source)
+}
+
+func fetchDeployedVcl(session *varnishCliSession) (string, error) {
+	content, err := session.Listener.backend.DeployedVcl()
+	if err != nil {
+		writeVarnishCliResponse(session.Writer, CLIS_CANT, err.Error())
+		return "", err
+	}
+	return content, nil
+}
@@ -0,0 +1,10 @@
+package main
+
+func handleVarnishCliVclState(configname string, state string, session *varnishCliSession) {
+	err := session.Listener.configs.setState(configname, state)
+	if err != nil {
+		writeVarnishCliResponse(session.Writer, CLIS_PARAM, err.Error())
+		return
+	}
+	writeVarnishCliResponse(session.Writer, CLIS_OK, ``)
+}
@@ -1,39 +1,212 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"io"
 	"log"
+	"strings"
+	"text/template"
+	"time"
 )
 
-type jsonUpdateVclRequest struct {
-	Personality string `json:"personality"`
-	Message     string `json:"message"`
-	Content     string `json:"content"`
+// vclMessageValues are the fields available to the VCL message template.
+type vclMessageValues struct {
+	ConfigName    string
+	ClientAddress string
+	Identity      string
+	Version       string
+	ContentHash   string
+	ApprovedBy    string
 }
 
-func handleVarnishCliVclUse(configname string, writer io.Writer) {
-	if configname != inlineConfigName {
-		writeVarnishCliResponse(writer, CLIS_PARAM, fmt.Sprintf(`No configuration named %s known.`, configname))
-		return
+var vclMessage *template.Template
+
+func parseVclMessageTemplate(text string) (err error) {
+	vclMessage, err = template.New("message").Parse(text)
+	if err != nil {
+		return fmt.Errorf("VCL message template is invalid: %v", err)
 	}
+	return nil
+}
 
-	//Post it to the API
-	postValues := jsonUpdateVclRequest{
-		Personality: "MagentoTurpentine",
-		Message:     "Update from varnish-cli-bridge",
-		Content:     inlineQuotedVCLstring,
+func formatVclMessage(values vclMessageValues) (string, error) {
+	var buffer bytes.Buffer
+	err := vclMessage.Execute(&buffer, values)
+	if err != nil {
+		return "", err
 	}
+	return buffer.String(), nil
+}
 
-	response, err := jsonPost(writer, sectionioApiEndpoint+"configuration", "configuration update", postValues)
+func handleVarnishCliVclUse(configname string, session *varnishCliSession) {
+	writer := session.Writer
+
+	config, ok := session.Listener.configs.resolve(configname)
+	if !ok {
+		writeVarnishCliResponse(writer, CLIS_PARAM, fmt.Sprintf(`No configuration named %s known.`, configname))
+		return
+	}
+	if config.State == vclStateCold {
+		writeVarnishCliResponse(writer, CLIS_CANT, fmt.Sprintf(`VCL '%s' is cold - set to auto or warm before making it active`, config.Name))
+		return
+	}
+	// detected again, as the rules may have changed since the config was
+	// loaded and configs restored from older state files have none
+	if personality := detectVclPersonality(config.Source); personality != "" {
+		config.Personality = personality
+	}
+	if config.Personality == "" {
+		writeVarnishCliResponse(writer, CLIS_CANT, fmt.Sprintf(`Unable to determine the section.io personality for VCL '%s'.`, config.Name))
+		return
+	}
 
+	content, err := transformVcl(config.Source)
 	if err != nil {
-		//CLI Response already written on non-200 or other error
+		log.Printf("Error transforming VCL '%s': %v", config.Name, err)
+		writeVarnishCliResponse(writer, CLIS_CANT, err.Error())
 		return
 	}
 
-	log.Printf("Update submitted. Response message: %s", response["message"])
+	// the policy applies to what is deployed, so check it after transforming
+	response := ``
+	program, syntaxError := parseVcl(content, session.Listener.vclGrammarVersion())
+	if syntaxError != nil {
+		log.Printf("Transformed VCL '%s' failed the syntax check: %v", config.Name, syntaxError)
+		writeVarnishCliResponse(writer, CLIS_CANT, formatVccError(content, config.SourceName, syntaxError))
+		return
+	}
+	program.Includes = config.Includes
+	violations, refused := checkVclPolicy(content, program)
+	if len(violations) > 0 {
+		policyMessage := formatVclPolicyViolations(violations, refused)
+		log.Printf("VCL config '%s' policy check:\n%s", config.Name, policyMessage)
+		if refused {
+			writeVarnishCliResponse(writer, CLIS_CANT, policyMessage)
+			return
+		}
+		response = policyMessage
+	}
 
+	if vclApprovalRequired() {
+		queueVclDeployment(session, config.Name, config.Personality, content, response)
+		return
+	}
+
+	summary, ok := deployVcl(session, config.Name, config.Personality, content, "")
+	if !ok {
+		return
+	}
+	// a dry run changes the active config too, so that clients carry on as
+	// they would after a real deployment
+	if err := session.Listener.configs.setActive(config.Name); err != nil {
+		writeVarnishCliResponse(writer, CLIS_CANT, joinResponseLines(response, summary, err.Error()))
+		return
+	}
 	//Varnishd actually returns a 200 & zero byte reponse (a problem to match since we add a trailing /n in writeVarnishCliResponse)
-	writeVarnishCliResponse(writer, CLIS_OK, ``)
+	writeVarnishCliResponse(writer, CLIS_OK, joinResponseLines(response, summary))
+}
+
+// isVclDeployed reports whether the backend has the content deployed, which
+// may have changed since the last deployment recorded in the history.
+func isVclDeployed(backend invalidationBackend, content string) bool {
+	deployed, err := backend.DeployedVcl()
+	if err != nil {
+		log.Printf("Unable to compare with the deployed VCL: %v", err)
+		return false
+	}
+	return deployed == content
+}
+
+// joinResponseLines joins the non-empty parts of a CLI response with newlines.
+func joinResponseLines(parts ...string) string {
+	lines := []string{}
+	for _, part := range parts {
+		if part != "" {
+			lines = append(lines, part)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// deployVcl deploys VCL content with the backend of the listener and records
+// it in the deployment history, unless it is identical to the deployed VCL.
+// It writes the CLI response only on failure, returning false, and otherwise
+// returns the backend's summary to include in the response.
+// The session is that of the client which requested the deployment, approvedBy
+// the identity of the approver when approval is required.
+func deployVcl(session *varnishCliSession, configName string, personality string, content string, approvedBy string) (string, bool) {
+	writer := session.Writer
+
+	contentHashBytes := sha256.Sum256([]byte(content))
+	contentHash := hex.EncodeToString(contentHashBytes[:])
+
+	history := session.Listener.history
+	previous, hasPrevious := history.latest()
+	// the personality is only known for deployments made by the bridge, the
+	// deployed VCL is only compared on the first target so a deployment which
+	// failed on others is retried, and a dry run sends no API requests at all
+	if !session.DryRun && isVclDeployed(session.Listener.backend, content) && (!hasPrevious || previous.Personality == personality && len(previous.Failures) == 0) {
+		log.Printf("VCL '%s' is identical to the VCL already deployed, skipping.", configName)
+		return "", true
+	}
+
+	message, err := formatVclMessage(vclMessageValues{
+		ConfigName:    configName,
+		ClientAddress: session.RemoteAddress,
+		Identity:      session.Identity,
+		Version:       version,
+		ContentHash:   contentHash,
+		ApprovedBy:    approvedBy,
+	})
+	if err != nil {
+		log.Printf("Error formatting VCL message: %v", err)
+		writeVarnishCliResponse(writer, CLIS_CANT, "Failed to format the configuration update message.")
+		return "", false
+	}
+
+	request := vclDeployRequest{
+		ConfigName:  configName,
+		Personality: personality,
+		Message:     message,
+		Content:     content,
+	}
+	if hasPrevious {
+		request.Previous = &previous
+	}
+	result := session.Listener.backend.DeployVcl(request, session.DryRun)
+	if !result.OK {
+		writeVarnishCliResponse(writer, CLIS_CANT, result.Summary)
+		return "", false
+	}
+	summary := result.Summary
+
+	if session.DryRun {
+		// nothing was deployed, so there is nothing to roll back to
+		return summary, true
+	}
+
+	deployment := vclDeployment{
+		ConfigName:    configName,
+		Personality:   personality,
+		Content:       content,
+		ContentHash:   contentHash,
+		Time:          time.Now().UTC(),
+		Identity:      session.Identity,
+		ClientAddress: session.RemoteAddress,
+		ApprovedBy:    approvedBy,
+		Response:      result.Response,
+	}
+	if len(result.Failures) > 0 {
+		deployment.Failures = result.Failures
+	}
+	deployment, err = history.record(deployment)
+	if err != nil {
+		// the VCL was deployed, but the history will not survive a restart
+		writeVarnishCliResponse(writer, CLIS_CANT, joinResponseLines(summary, err.Error()))
+		return "", false
+	}
+	log.Printf("Recorded VCL '%s' as revision %d.", configName, deployment.Revision)
+	return summary, true
 }
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// httpBanMapping turns the value of a request header into a condition of a
+// ban expression.
+type httpBanMapping struct {
+	Header   string
+	Field    string
+	Operator string
+}
+
+const defaultHttpBanMappings = "X-Magento-Tags-Pattern:obj.http.X-Magento-Tags:~,X-Purge-Regex:req.url:~"
+
+// defaultHttpAllowedClients allows only local clients, as the purge ACL of a
+// typical VCL does.
+const defaultHttpAllowedClients = "127.0.0.1,::1"
+
+// httpTokenHeader carries the shared token when a token file is configured.
+const httpTokenHeader = "X-Purge-Token"
+
+// httpReadHeaderTimeout bounds how long a client may take to send the
+// request headers.
+const httpReadHeaderTimeout = 10 * time.Second
+
+var (
+	httpBanMappingList []httpBanMapping
+	// httpAllowedNetworks are the client addresses the HTTP frontend accepts
+	// requests from, any when empty
+	httpAllowedNetworks []*net.IPNet
+	// httpToken must be sent in httpTokenHeader when not empty
+	httpToken string
+)
+
+// parseHttpBanMappings parses a comma-separated list of mappings, each of a
+// header name, a ban field and optionally an operator, separated by colons.
+// The operator defaults to ~.
+func parseHttpBanMappings(text string) ([]httpBanMapping, error) {
+	mappings := []httpBanMapping{}
+	for _, entry := range strings.Split(text, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("HTTP ban mapping '%s' must be HEADER:FIELD[:OPERATOR].", entry)
+		}
+		mapping := httpBanMapping{Header: http.CanonicalHeaderKey(parts[0]), Field: parts[1], Operator: "~"}
+		if len(parts) == 3 {
+			mapping.Operator = parts[2]
+		}
+		switch mapping.Operator {
+		case "~", "!~", "==", "!=":
+		default:
+			return nil, fmt.Errorf("HTTP ban mapping '%s' has an unknown operator '%s'.", entry, mapping.Operator)
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
+
+// parseHttpAllowedClients parses a comma-separated list of client addresses,
+// each an IP address or a CIDR network.
+func parseHttpAllowedClients(text string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, entry := range strings.Split(text, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("HTTP allowed client '%s' is not an IP address or network.", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("HTTP allowed client '%s' is not an IP address or network.", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// loadHttpToken reads the shared token of the HTTP frontend from a file,
+// ignoring surrounding whitespace.
+func loadHttpToken(file string) (string, error) {
+	tokenBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read HTTP token file '%s': %v", file, err)
+	}
+	token := strings.TrimSpace(string(tokenBytes))
+	if token == "" {
+		return "", fmt.Errorf("HTTP token file '%s' is empty.", file)
+	}
+	return token, nil
+}
+
+// httpClientAllowed checks the address of a request against the allowed
+// networks.
+func httpClientAllowed(remoteAddress string) bool {
+	if len(httpAllowedNetworks) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddress)
+	if err != nil {
+		host = remoteAddress
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range httpAllowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpBanHandler accepts PURGE and BAN requests as sent by purge plugins
+// written for Varnish, and applies them as bans with the backend of the
+// listener.
+type httpBanHandler struct {
+	Listener *varnishCliListener
+}
+
+// httpBanExpression builds a ban expression from the mapped headers of a
+// request, all of which must match. A request without any purges its URL on
+// its host.
+func httpBanExpression(request *http.Request, mappings []httpBanMapping) string {
+	args := []string{}
+	for _, mapping := range mappings {
+		value := request.Header.Get(mapping.Header)
+		if value == "" {
+			continue
+		}
+		if len(args) > 0 {
+			args = append(args, "&&")
+		}
+		args = append(args, mapping.Field, mapping.Operator, value)
+	}
+	if len(args) > 0 {
+		return varnishQuoteArgs(args)
+	}
+
+	args = []string{"req.url", "==", request.URL.RequestURI()}
+	if request.Host != "" {
+		args = append(args, "&&", "req.http.host", "==", request.Host)
+	}
+	return varnishQuoteArgs(args)
+}
+
+func (handler *httpBanHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "PURGE" && request.Method != "BAN" {
+		writer.Header().Set("Allow", "PURGE, BAN")
+		http.Error(writer, "Only PURGE and BAN requests are accepted.", http.StatusMethodNotAllowed)
+		return
+	}
+	if !httpClientAllowed(request.RemoteAddr) {
+		log.Printf("HTTP %s from %s refused, the client is not allowed.", request.Method, request.RemoteAddr)
+		http.Error(writer, "The client is not allowed.", http.StatusForbidden)
+		return
+	}
+	if httpToken != "" && subtle.ConstantTimeCompare([]byte(request.Header.Get(httpTokenHeader)), []byte(httpToken)) != 1 {
+		log.Printf("HTTP %s from %s refused, the token is missing or wrong.", request.Method, request.RemoteAddr)
+		http.Error(writer, "The "+httpTokenHeader+" header is missing or wrong.", http.StatusForbidden)
+		return
+	}
+
+	session := &varnishCliSession{
+		HasAuthenticated: true,
+		RemoteAddress:    request.RemoteAddr,
+		Identity:         "http",
+		DryRun:           dryRun,
+		Listener:         handler.Listener,
+	}
+
+	if keys := request.Header.Get(httpPurgeKeysHeader); keys != "" {
+		log.Printf("HTTP %s from %s: purge keys %s", request.Method, request.RemoteAddr, keys)
+		status, response := purgeKeys(splitSurrogateKeys(keys), session)
+		writeHttpBanResponse(writer, status, response)
+		return
+	}
+
+	expression := httpBanExpression(request, httpBanMappingList)
+	log.Printf("HTTP %s from %s for %s: ban %s", request.Method, request.RemoteAddr, request.URL.RequestURI(), expression)
+	status, response := applyBan(expression, session)
+	writeHttpBanResponse(writer, status, response)
+}
+
+// writeHttpBanResponse answers with an HTTP status reflecting the CLI status
+// of the outcome.
+func writeHttpBanResponse(writer http.ResponseWriter, status VarnishCliResponseStatus, response string) {
+	httpStatus := http.StatusOK
+	switch status {
+	case CLIS_OK:
+	case CLIS_PARAM:
+		httpStatus = http.StatusBadRequest
+	default:
+		httpStatus = http.StatusBadGateway
+	}
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writer.WriteHeader(httpStatus)
+	fmt.Fprintln(writer, response)
+}
+
+// serveHttpFrontend serves the HTTP frontend of a listener until it fails.
+func serveHttpFrontend(listener *varnishCliListener) error {
+	log.Printf("Listener '%s' accepting HTTP PURGE and BAN requests on '%s'.", listener.Name, listener.HttpListenAddress)
+	server := &http.Server{
+		Addr:              listener.HttpListenAddress,
+		Handler:           &httpBanHandler{Listener: listener},
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+	}
+	return server.ListenAndServe()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHttpBanRequestsAreMapped(t *testing.T) {
+	defer func(previous []httpBanMapping) { httpBanMappingList = previous }(httpBanMappingList)
+	mappings, err := parseHttpBanMappings(defaultHttpBanMappings + ",x-ban-host:req.http.host:==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpBanMappingList = mappings
+
+	backend := &fakeBackend{}
+	listener := newTestListener("4.1")
+	listener.backend = backend
+	server := httptest.NewServer(&httpBanHandler{Listener: listener})
+	defer server.Close()
+
+	send := func(method string, path string, headers map[string]string) *http.Response {
+		request, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		ioutil.ReadAll(response.Body)
+		return response
+	}
+
+	// as sent by Magento 2 for a category and a product
+	response := send("PURGE", "/", map[string]string{"X-Magento-Tags-Pattern": "((^|,)cat_c_3(,|$))|((^|,)cat_p_7(,|$))"})
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 but was %d.", response.StatusCode)
+	}
+	response = send("BAN", "/", map[string]string{"X-Purge-Regex": `^/blog/.*\.html$`, "X-Ban-Host": "example.com"})
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 but was %d.", response.StatusCode)
+	}
+	send("PURGE", "/about-us/?lang=en", nil)
+
+	expected := []string{
+		`"obj.http.X-Magento-Tags" "~" "((^|,)cat_c_3(,|$))|((^|,)cat_p_7(,|$))"`,
+		`"req.url" "~" "^/blog/.*\\.html$" "&&" "req.http.host" "==" "example.com"`,
+		`"req.url" "==" "/about-us/?lang=en" "&&" "req.http.host" "==" "` + strings.TrimPrefix(server.URL, "http://") + `"`,
+	}
+	if len(backend.bans) != len(expected) {
+		t.Fatalf("Expected %#v but was %#v.", expected, backend.bans)
+	}
+	for index := range expected {
+		if backend.bans[index] != expected[index] {
+			t.Errorf("Expected %s but was %s.", expected[index], backend.bans[index])
+		}
+		// the expression must survive the CLI tokenizer as varnishd would parse it
+		if tokens := tokenizeRequest(backend.bans[index]); len(tokens)%4 != 3 {
+			t.Errorf("Expected conditions of three tokens but was %#v.", tokens)
+		}
+	}
+
+	response = send("GET", "/", nil)
+	if response.StatusCode != http.StatusMethodNotAllowed || response.Header.Get("Allow") != "PURGE, BAN" {
+		t.Errorf("Expected GET to be refused but was %d.", response.StatusCode)
+	}
+}
+
+func TestHttpBanFailureIsBadGateway(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.WriteHeader(500)
+	}))
+	defer failing.Close()
+	server := httptest.NewServer(&httpBanHandler{Listener: newTestListener("4.1", failing.URL)})
+	defer server.Close()
+
+	request, _ := http.NewRequest("PURGE", server.URL+"/", nil)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusBadGateway || !strings.Contains(string(body), "500") {
+		t.Errorf("Expected status 502 describing the failure but was %d %#v.", response.StatusCode, string(body))
+	}
+}
+
+func TestParseHttpBanMappingsRefusesUnknownOperator(t *testing.T) {
+	if _, err := parseHttpBanMappings("X-Purge-Regex:req.url:=~"); err == nil {
+		t.Errorf("Expected an unknown operator to be refused.")
+	}
+	if _, err := parseHttpBanMappings("X-Purge-Regex"); err == nil {
+		t.Errorf("Expected a mapping without a field to be refused.")
+	}
+}
+
+func TestHttpBanRefusesUnauthorizedClients(t *testing.T) {
+	defer func(previousNetworks []*net.IPNet, previousToken string) {
+		httpAllowedNetworks = previousNetworks
+		httpToken = previousToken
+	}(httpAllowedNetworks, httpToken)
+
+	backend := &fakeBackend{}
+	listener := newTestListener("4.1")
+	listener.backend = backend
+	server := httptest.NewServer(&httpBanHandler{Listener: listener})
+	defer server.Close()
+
+	send := func(token string) int {
+		request, err := http.NewRequest("PURGE", server.URL+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			request.Header.Set(httpTokenHeader, token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	httpAllowedNetworks, _ = parseHttpAllowedClients("10.0.0.0/8, 192.0.2.1")
+	if status := send(""); status != http.StatusForbidden {
+		t.Errorf("Expected a client outside the allowed networks to be refused but was %d.", status)
+	}
+
+	httpAllowedNetworks, _ = parseHttpAllowedClients(defaultHttpAllowedClients)
+	httpToken = "shared token"
+	if status := send(""); status != http.StatusForbidden {
+		t.Errorf("Expected a request without the token to be refused but was %d.", status)
+	}
+	if status := send("wrong token"); status != http.StatusForbidden {
+		t.Errorf("Expected a request with the wrong token to be refused but was %d.", status)
+	}
+	if len(backend.bans) != 0 {
+		t.Errorf("Expected no bans from refused requests but was %#v.", backend.bans)
+	}
+	if status := send("shared token"); status != http.StatusOK || len(backend.bans) != 1 {
+		t.Errorf("Expected an allowed client with the token to ban but was %d, %#v.", status, backend.bans)
+	}
+}
+
+func TestParseHttpAllowedClientsRefusesInvalidAddress(t *testing.T) {
+	_, err := parseHttpAllowedClients("127.0.0.1,localhost")
+	if err == nil || err.Error() != "HTTP allowed client 'localhost' is not an IP address or network." {
+		t.Errorf("Expected the host name to be refused but was %v.", err)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+)
+
+// varnishCliListener is the configuration of one address on which the bridge
+// accepts Varnish CLI connections. Each listener simulates a separate
+// varnishd, so it has its own VCL registry and deployment history.
+type varnishCliListener struct {
+	Name          string `json:"name"`
+	ListenAddress string `json:"listenAddress"`
+	// ManagementAddresses are consoles the listener connects to, as varnishd
+	// -M does
+	ManagementAddresses string `json:"managementAddresses"`
+	// HttpListenAddress accepts HTTP PURGE and BAN requests when set
+	HttpListenAddress string `json:"httpListenAddress"`
+	SecretFile        string `json:"secretFile"`
+	// Identity names the clients which authenticate with SecretFile
+	Identity       string `json:"identity"`
+	VarnishVersion string `json:"varnishVersion"`
+	BannerVersion  string `json:"bannerVersion"`
+	ApiEndpoint    string `json:"apiEndpoint"`
+	Backend        string `json:"backend"`
+	// the relay backend sends to RelayTargets and those discovered from
+	// RelayTargetsFile and RelayTargetsDns
+	RelayTargets     string `json:"relayTargets"`
+	RelayTargetsFile string `json:"relayTargetsFile"`
+	RelayTargetsDns  string `json:"relayTargetsDns"`
+	RelaySecretFile  string `json:"relaySecretFile"`
+	// commands the bridge does not handle are passed through to the varnishd
+	// at UpstreamAddress, when set
+	UpstreamAddress    string `json:"upstreamAddress"`
+	UpstreamSecretFile string `json:"upstreamSecretFile"`
+
+	backend   invalidationBackend
+	upstream  *varnishCliPool
+	configs   *vclRegistry
+	history   *vclHistoryLog
+	approvals *vclApprovalQueue
+}
+
+var listenerNameRx = regexp.MustCompile(`^[A-Za-z0-9_-]*$`)
+
+// loadListeners reads a JSON array of listener configurations. Settings left
+// out of an entry are taken from defaults.
+func loadListeners(file string, defaults varnishCliListener) ([]*varnishCliListener, error) {
+	listenersBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read listeners file '%s': %v", file, err)
+	}
+	var entries []varnishCliListener
+	err = json.Unmarshal(listenersBytes, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse listeners file '%s': %v", file, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("Listeners file '%s' has no listeners", file)
+	}
+
+	listeners := []*varnishCliListener{}
+	names := map[string]bool{}
+	for _, entry := range entries {
+		listener := defaults
+		listener.Name = entry.Name
+		if entry.ListenAddress != "" {
+			listener.ListenAddress = entry.ListenAddress
+		}
+		if entry.ManagementAddresses != "" {
+			listener.ManagementAddresses = entry.ManagementAddresses
+		}
+		if entry.HttpListenAddress != "" {
+			listener.HttpListenAddress = entry.HttpListenAddress
+		}
+		if entry.SecretFile != "" {
+			// an identity of the default secret does not name this one
+			listener.SecretFile = entry.SecretFile
+			listener.Identity = ""
+		}
+		if entry.Identity != "" {
+			listener.Identity = entry.Identity
+		}
+		if entry.VarnishVersion != "" {
+			listener.VarnishVersion = entry.VarnishVersion
+		}
+		if entry.BannerVersion != "" {
+			listener.BannerVersion = entry.BannerVersion
+		}
+		if entry.ApiEndpoint != "" {
+			listener.ApiEndpoint = entry.ApiEndpoint
+		}
+		if entry.Backend != "" {
+			listener.Backend = entry.Backend
+		}
+		if entry.RelayTargets != "" {
+			listener.RelayTargets = entry.RelayTargets
+		}
+		if entry.RelayTargetsFile != "" {
+			listener.RelayTargetsFile = entry.RelayTargetsFile
+		}
+		if entry.RelayTargetsDns != "" {
+			listener.RelayTargetsDns = entry.RelayTargetsDns
+		}
+		if entry.RelaySecretFile != "" {
+			listener.RelaySecretFile = entry.RelaySecretFile
+		}
+		if entry.UpstreamAddress != "" {
+			listener.UpstreamAddress = entry.UpstreamAddress
+		}
+		if entry.UpstreamSecretFile != "" {
+			listener.UpstreamSecretFile = entry.UpstreamSecretFile
+		}
+
+		if !listenerNameRx.MatchString(listener.Name) {
+			return nil, fmt.Errorf("Listener name '%s' may only contain letters, digits, '-' and '_'", listener.Name)
+		}
+		if names[listener.Name] {
+			return nil, fmt.Errorf("Listener name '%s' is used more than once", listener.Name)
+		}
+		names[listener.Name] = true
+		listeners = append(listeners, &listener)
+	}
+	return listeners, nil
+}
+
+// prepare validates the listener and creates its backend and upstream.
+func (listener *varnishCliListener) prepare() error {
+	if !isSupportedVarnishVersion(listener.VarnishVersion) {
+		return fmt.Errorf("Listener '%s': only Varnish version 3.0, 4.0, 4.1, or 5.0 is supported.", listener.Name)
+	}
+	if listener.ListenAddress == listenAddressNone && len(parseManagementAddresses(listener.ManagementAddresses)) == 0 && listener.HttpListenAddress == "" {
+		return fmt.Errorf("Listener '%s': a management or HTTP listen address is required when the listen address is none.", listener.Name)
+	}
+	if listener.BannerVersion == "" {
+		listener.BannerVersion = fmt.Sprintf("varnish-%s.0 revision 0000000", listener.VarnishVersion)
+	}
+
+	backend, err := newInvalidationBackend(listener)
+	if err != nil {
+		return fmt.Errorf("Listener '%s': %v", listener.Name, err)
+	}
+	listener.backend = backend
+	if listener.UpstreamAddress != "" {
+		listener.upstream = &varnishCliPool{Address: listener.UpstreamAddress, SecretFile: listener.UpstreamSecretFile, Source: "upstream"}
+	}
+	listener.configs = &vclRegistry{}
+	listener.history = &vclHistoryLog{}
+	listener.approvals = &vclApprovalQueue{}
+	return nil
+}
+
+// loadState restores the VCL registry and deployment history of the listener
+// from the state directory. The unnamed listener uses the file names from
+// before there could be several listeners.
+func (listener *varnishCliListener) loadState(directory string) error {
+	suffix := ""
+	if listener.Name != "" {
+		suffix = "-" + listener.Name
+	}
+	err := listener.configs.load(filepath.Join(directory, "vcl-registry"+suffix+".json"))
+	if err != nil {
+		return err
+	}
+	return listener.history.load(filepath.Join(directory, "vcl-history"+suffix+".json"))
+}
+
+// secretIdentity is the identity of clients which authenticate with the
+// secret file: the configured identity, otherwise the path of the file.
+func (listener *varnishCliListener) secretIdentity() string {
+	if listener.Identity != "" {
+		return listener.Identity
+	}
+	return listener.SecretFile
+}
+
+func isSupportedVarnishVersion(varnishVersion string) bool {
+	return varnishVersion == "3.0" || varnishVersion == "4.0" || varnishVersion == "4.1" || varnishVersion == "5.0"
+}
+
+func (listener *varnishCliListener) varnishVersionAtLeast(major int, minor int) bool {
+	var versionMajor, versionMinor int
+	_, err := fmt.Sscanf(listener.VarnishVersion, "%d.%d", &versionMajor, &versionMinor)
+	if err != nil {
+		return false
+	}
+	return versionMajor > major || (versionMajor == major && versionMinor >= minor)
+}
+
+// vclGrammarVersion is the major version of the VCL grammar accepted by the
+// simulated Varnish version.
+func (listener *varnishCliListener) vclGrammarVersion() int {
+	if listener.varnishVersionAtLeast(4, 0) {
+		return 4
+	}
+	return 3
+}
+
+// maximumVclArgumentCount allows for the trailing auto|cold|warm argument of
+// vcl.inline and vcl.load from Varnish 4.1.
+func (listener *varnishCliListener) maximumVclArgumentCount(count int) int {
+	if listener.varnishVersionAtLeast(4, 1) {
+		return count + 1
+	}
+	return count
+}
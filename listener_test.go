@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestListener(varnishVersion string, urls ...string) *varnishCliListener {
+	return &varnishCliListener{
+		VarnishVersion: varnishVersion,
+		BannerVersion:  "varnish-" + varnishVersion + ".0 revision 0000000",
+		backend:        &sectionioBackend{targets: newTestSectionioTargets(urls...)},
+		configs:        &vclRegistry{},
+		history:        &vclHistoryLog{},
+		approvals:      &vclApprovalQueue{},
+	}
+}
+
+func TestLoadListenersAppliesDefaults(t *testing.T) {
+	directory, err := ioutil.TempDir("", "listeners")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	file := filepath.Join(directory, "listeners.json")
+	ioutil.WriteFile(file, []byte(`[
+		{"listenAddress": "127.0.0.1:6082"},
+		{"name": "staging", "listenAddress": "127.0.0.1:6083", "varnishVersion": "4.1", "secretFile": "/etc/varnish/staging-secret",
+		 "apiEndpoint": "https://aperture.section.io/api/v1/account/1/application/3"}
+	]`), 0644)
+
+	defaults := varnishCliListener{
+		SecretFile:     "/etc/varnish/secret",
+		Identity:       "ops",
+		VarnishVersion: "3.0",
+		ApiEndpoint:    "https://aperture.section.io/api/v1/account/1/application/2",
+		Backend:        sectionioBackendName,
+	}
+	previousUsername, previousPassword := sectionioUsername, sectionioPassword
+	sectionioUsername, sectionioPassword = "user", "password"
+	defer func() { sectionioUsername, sectionioPassword = previousUsername, previousPassword }()
+
+	listeners, err := loadListeners(file, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("Expected 2 listeners but was %d.", len(listeners))
+	}
+	for _, listener := range listeners {
+		if err := listener.prepare(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, second := listeners[0], listeners[1]
+	if first.SecretFile != "/etc/varnish/secret" || first.BannerVersion != "varnish-3.0.0 revision 0000000" || first.backend.(*sectionioBackend).targets[0].Application != "2" {
+		t.Errorf("Expected the first listener to use the defaults but was %#v.", first)
+	}
+	if second.SecretFile != "/etc/varnish/staging-secret" || second.BannerVersion != "varnish-4.1.0 revision 0000000" || second.backend.(*sectionioBackend).targets[0].Application != "3" {
+		t.Errorf("Expected the second listener to use its own settings but was %#v.", second)
+	}
+	if first.secretIdentity() != "ops" || second.secretIdentity() != "/etc/varnish/staging-secret" {
+		t.Errorf("Expected the default identity only for the default secret file but was %#v and %#v.", first.secretIdentity(), second.secretIdentity())
+	}
+	if first.configs == second.configs || first.history == second.history || first.approvals == second.approvals {
+		t.Errorf("Expected each listener to have its own registry, history and approval queue.")
+	}
+
+	ioutil.WriteFile(file, []byte(`[{"name": "a"}, {"name": "a"}]`), 0644)
+	if _, err := loadListeners(file, defaults); err == nil {
+		t.Errorf("Expected duplicate listener names to be refused.")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -18,6 +19,11 @@ type varnishCliSession struct {
 	Writer           io.Writer
 	HasAuthenticated bool
 	AuthChallenge    string
+	RemoteAddress    string
+	Identity         string
+	IsApprover       bool
+	DryRun           bool
+	Listener         *varnishCliListener
 }
 
 var (
@@ -26,19 +32,45 @@ var (
 		Timeout: time.Minute,
 	}
 
-	listenAddress = "127.0.0.1:6082"
-	secretFile    string
+	listenAddress       = "127.0.0.1:6082"
+	managementAddresses string
+	httpListenAddress   string
+	httpBanMappings     = defaultHttpBanMappings
+	httpPurgeKeysHeader = "Xkey-Purge"
+	httpAllowedClients  = defaultHttpAllowedClients
+	httpTokenFile       string
+	secretFile          string
+	identity            string
 
 	varnishVersion       = "3.0"
 	bannerVarnishVersion string
 
-	// eg "https://aperture.section.io/api/v1/account/1/application/1/"
-	sectionioApiEndpoint  string
+	vclShowDeployed         bool
+	vclPersonality          string
+	vclPersonalityRulesFile string
+	vclMessageTemplate      = "Update from varnish-cli-bridge"
+	vclTransforms           string
+	vclPolicyFile           string
+	vclDirectory            string
+	stateDirectory          string
+	approverSecretFile      string
+	dryRun                  bool
+	vclApprovalTimeout      = time.Hour
+	listenersFile           string
+	relayTargets            string
+	relayTargetsFile        string
+	relayTargetsDns         string
+	relaySecretFile         string
+	relayDiscoveryInterval  = 30 * time.Second
+	upstreamAddress         string
+	upstreamSecretFile      string
+	listeners               []*varnishCliListener
+
+	// eg "https://aperture.section.io/api/v1/account/1/application/1/", or
+	// several separated by commas
+	sectionioApiEndpoints string
 	sectionioUsername     string
 	sectionioPassword     string
-	sectionioApiUrlPrefix string
-	sectionioAccount      string
-	sectionioApplication  string
 	sectionioEnvironment  = "Production"
 	sectionioProxyName    = "varnish"
 
@@ -47,37 +79,10 @@ var (
 	userAgent  string
 )
 
-func parseApiEndpoint(endpoint string, errorMessage string) {
-	match := sectionioApiEndpointRx.FindAllStringSubmatch(endpoint, -1)
-	if match != nil {
-		names := sectionioApiEndpointRx.SubexpNames()
-		nameMap := map[string]string{}
-		for i, n := range match[0] {
-			nameMap[names[i]] = n
-		}
-
-		sectionioApiUrlPrefix = nameMap["prefix"]
-		sectionioAccount = nameMap["account"]
-		sectionioApplication = nameMap["application"]
-		if nameMap["environment"] != "" {
-			sectionioEnvironment = nameMap["environment"]
-		}
-		if nameMap["proxy"] != "" {
-			sectionioProxyName = nameMap["proxy"]
-		}
-
-		sectionioApiEndpoint = fmt.Sprintf("%s/account/%s/application/%s/environment/%s/proxy/%s/", sectionioApiUrlPrefix, sectionioAccount, sectionioApplication, sectionioEnvironment, sectionioProxyName)
-	} else {
-		log.Fatal(errorMessage)
-	}
-}
-
 func configure() {
 	const cliEnvKeyPrefix = "VARNISH_CLI_BRIDGE_"
 	const sectionioEnvKeyPrefix = "SECTION_IO_"
 
-	var sectionioApiEndpointArgVal string
-
 	userAgent = fmt.Sprintf("section.io varnish-cli-bridge, version %s, commit %s", version, commitHash)
 	log.Printf("varnish-cli-bridge Version: %s, Commit: %s", version, commitHash)
 
@@ -86,7 +91,67 @@ func configure() {
 		listenAddress = envListenAddress
 	}
 	flag.StringVar(&listenAddress, "listen-address", listenAddress,
-		"Address and port to listen for inbound Varnish CLI connections.")
+		"Address and port to listen for inbound Varnish CLI connections, or none.")
+
+	envManagementAddress := os.Getenv(cliEnvKeyPrefix + "MANAGEMENT_ADDRESS")
+	if envManagementAddress != "" {
+		managementAddresses = envManagementAddress
+	}
+	flag.StringVar(&managementAddresses, "management-address", managementAddresses,
+		"Addresses of management consoles to connect to and serve the Varnish CLI over, like varnishd -M, separated by commas.")
+
+	envHttpListenAddress := os.Getenv(cliEnvKeyPrefix + "HTTP_LISTEN_ADDRESS")
+	if envHttpListenAddress != "" {
+		httpListenAddress = envHttpListenAddress
+	}
+	flag.StringVar(&httpListenAddress, "http-listen-address", httpListenAddress,
+		"Address and port to accept HTTP PURGE and BAN requests on, disabled if empty.")
+
+	envHttpBanMappings := os.Getenv(cliEnvKeyPrefix + "HTTP_BAN_MAPPINGS")
+	if envHttpBanMappings != "" {
+		httpBanMappings = envHttpBanMappings
+	}
+	flag.StringVar(&httpBanMappings, "http-ban-mappings", httpBanMappings,
+		"How headers of HTTP PURGE and BAN requests become ban conditions, as HEADER:FIELD[:OPERATOR] separated by commas.")
+
+	envHttpPurgeKeysHeader := os.Getenv(cliEnvKeyPrefix + "HTTP_PURGE_KEYS_HEADER")
+	if envHttpPurgeKeysHeader != "" {
+		httpPurgeKeysHeader = envHttpPurgeKeysHeader
+	}
+	flag.StringVar(&httpPurgeKeysHeader, "http-purge-keys-header", httpPurgeKeysHeader,
+		"The header of HTTP PURGE and BAN requests listing surrogate keys to purge as purge.keys does.")
+
+	envHttpAllowedClients := os.Getenv(cliEnvKeyPrefix + "HTTP_ALLOWED_CLIENTS")
+	if envHttpAllowedClients != "" {
+		httpAllowedClients = envHttpAllowedClients
+	}
+	flag.StringVar(&httpAllowedClients, "http-allowed-clients", httpAllowedClients,
+		"IP addresses and networks allowed to send HTTP PURGE and BAN requests, separated by commas, any if empty.")
+
+	envHttpTokenFile := os.Getenv(cliEnvKeyPrefix + "HTTP_TOKEN_FILE")
+	if envHttpTokenFile != "" {
+		httpTokenFile = envHttpTokenFile
+	}
+	flag.StringVar(&httpTokenFile, "http-token-file", httpTokenFile,
+		"File with a token HTTP PURGE and BAN requests must send in the "+httpTokenHeader+" header.")
+
+	envSurrogateKeyField := os.Getenv(cliEnvKeyPrefix + "SURROGATE_KEY_FIELD")
+	if envSurrogateKeyField != "" {
+		surrogateKeyField = envSurrogateKeyField
+	}
+	flag.StringVar(&surrogateKeyField, "surrogate-key-field", surrogateKeyField,
+		"The ban field holding the surrogate keys of objects, for purge.keys.")
+
+	envMaximumBanLength := os.Getenv(cliEnvKeyPrefix + "MAX_BAN_LENGTH")
+	if envMaximumBanLength != "" {
+		parsed, err := strconv.Atoi(envMaximumBanLength)
+		if err != nil {
+			log.Fatal(cliEnvKeyPrefix + "MAX_BAN_LENGTH must be a number of bytes.")
+		}
+		maximumBanLength = parsed
+	}
+	flag.IntVar(&maximumBanLength, "max-ban-length", maximumBanLength,
+		"The longest ban expression purge.keys sends, in bytes, splitting longer key lists across several bans.")
 
 	envSecretFile := os.Getenv(cliEnvKeyPrefix + "SECRET_FILE")
 	if envSecretFile != "" {
@@ -95,15 +160,19 @@ func configure() {
 	flag.StringVar(&secretFile, "secret-file", secretFile,
 		"Path to file containing the Varnish CLI authentication secret.")
 
+	envIdentity := os.Getenv(cliEnvKeyPrefix + "IDENTITY")
+	if envIdentity != "" {
+		identity = envIdentity
+	}
+	flag.StringVar(&identity, "identity", identity,
+		"The identity recorded for clients which authenticate with the secret file, the file name if empty.")
+
 	envVarnishVersion := os.Getenv(cliEnvKeyPrefix + "VARNISH_VERSION")
 	if envVarnishVersion != "" {
 		varnishVersion = envVarnishVersion
 	}
 	flag.StringVar(&varnishVersion, "varnish-version", varnishVersion,
 		"Varnish version to simulate in the protocol.")
-	if varnishVersion != "3.0" && varnishVersion != "4.0" && varnishVersion != "4.1" {
-		log.Fatal("Only Varnish version 3.0, 4.0, or 4.1 is supported.")
-	}
 
 	envBannerVarnishVersion := os.Getenv(cliEnvKeyPrefix + "BANNER_VERSION")
 	if envBannerVarnishVersion != "" {
@@ -112,12 +181,175 @@ func configure() {
 	flag.StringVar(&bannerVarnishVersion, "banner-version", bannerVarnishVersion,
 		"Varnish version text to include in the protocol banner text.")
 
+	envListenersFile := os.Getenv(cliEnvKeyPrefix + "LISTENERS_FILE")
+	if envListenersFile != "" {
+		listenersFile = envListenersFile
+	}
+	flag.StringVar(&listenersFile, "listeners-file", listenersFile,
+		"Path to a JSON file configuring several listeners, each with its own address, secret, Varnish version, banner and API endpoint.")
+
+	envVclShowDeployed := os.Getenv(cliEnvKeyPrefix + "VCL_SHOW_DEPLOYED")
+	if envVclShowDeployed != "" {
+		parsed, err := strconv.ParseBool(envVclShowDeployed)
+		if err != nil {
+			log.Fatal(cliEnvKeyPrefix + "VCL_SHOW_DEPLOYED must be true or false.")
+		}
+		vclShowDeployed = parsed
+	}
+	flag.BoolVar(&vclShowDeployed, "vcl-show-deployed", vclShowDeployed,
+		"Make vcl.show of the active config return the VCL currently deployed on section.io.")
+
+	envVclDirectory := os.Getenv(cliEnvKeyPrefix + "VCL_DIR")
+	if envVclDirectory != "" {
+		vclDirectory = envVclDirectory
+	}
+	flag.StringVar(&vclDirectory, "vcl-dir", vclDirectory,
+		"Directory from which vcl.load may read VCL files.")
+
+	envStateDirectory := os.Getenv(cliEnvKeyPrefix + "STATE_DIR")
+	if envStateDirectory != "" {
+		stateDirectory = envStateDirectory
+	}
+	flag.StringVar(&stateDirectory, "state-dir", stateDirectory,
+		"Directory in which to persist the VCL registry and deployment history across restarts.")
+
+	envVclPersonality := os.Getenv(cliEnvKeyPrefix + "VCL_PERSONALITY")
+	if envVclPersonality != "" {
+		vclPersonality = envVclPersonality
+	}
+	flag.StringVar(&vclPersonality, "vcl-personality", vclPersonality,
+		"The section.io personality to deploy all VCL with, instead of detecting it from the VCL.")
+
+	envVclPersonalityRulesFile := os.Getenv(cliEnvKeyPrefix + "VCL_PERSONALITY_RULES_FILE")
+	if envVclPersonalityRulesFile != "" {
+		vclPersonalityRulesFile = envVclPersonalityRulesFile
+	}
+	flag.StringVar(&vclPersonalityRulesFile, "vcl-personality-rules-file", vclPersonalityRulesFile,
+		"Path to a JSON file of rules for detecting the section.io personality from VCL.")
+
+	envVclMessageTemplate := os.Getenv(cliEnvKeyPrefix + "VCL_MESSAGE_TEMPLATE")
+	if envVclMessageTemplate != "" {
+		vclMessageTemplate = envVclMessageTemplate
+	}
+	flag.StringVar(&vclMessageTemplate, "vcl-message-template", vclMessageTemplate,
+		"Go template for the section.io change message recorded on vcl.use.")
+
+	envVclTransforms := os.Getenv(cliEnvKeyPrefix + "VCL_TRANSFORMS")
+	if envVclTransforms != "" {
+		vclTransforms = envVclTransforms
+	}
+	flag.StringVar(&vclTransforms, "vcl-transforms", vclTransforms,
+		"Comma-separated steps to transform VCL with before it is deployed.")
+
+	envVclPolicyFile := os.Getenv(cliEnvKeyPrefix + "VCL_POLICY_FILE")
+	if envVclPolicyFile != "" {
+		vclPolicyFile = envVclPolicyFile
+	}
+	flag.StringVar(&vclPolicyFile, "vcl-policy-file", vclPolicyFile,
+		"Path to a JSON file of policy rules VCL must pass to be used.")
+
+	envApproverSecretFile := os.Getenv(cliEnvKeyPrefix + "APPROVER_SECRET_FILE")
+	if envApproverSecretFile != "" {
+		approverSecretFile = envApproverSecretFile
+	}
+	flag.StringVar(&approverSecretFile, "approver-secret-file", approverSecretFile,
+		"Paths to files containing the Varnish CLI secrets of approvers, each optionally preceded by IDENTITY=, separated by commas, requiring approval of vcl.use.")
+
+	envVclApprovalTimeout := os.Getenv(cliEnvKeyPrefix + "VCL_APPROVAL_TIMEOUT")
+	if envVclApprovalTimeout != "" {
+		parsed, err := time.ParseDuration(envVclApprovalTimeout)
+		if err != nil {
+			log.Fatal(cliEnvKeyPrefix + "VCL_APPROVAL_TIMEOUT must be a duration like 30m.")
+		}
+		vclApprovalTimeout = parsed
+	}
+	flag.DurationVar(&vclApprovalTimeout, "vcl-approval-timeout", vclApprovalTimeout,
+		"How long a VCL deployment waits for approval before it expires.")
+
+	envDryRun := os.Getenv(cliEnvKeyPrefix + "DRY_RUN")
+	if envDryRun != "" {
+		parsed, err := strconv.ParseBool(envDryRun)
+		if err != nil {
+			log.Fatal(cliEnvKeyPrefix + "DRY_RUN must be true or false.")
+		}
+		dryRun = parsed
+	}
+	flag.BoolVar(&dryRun, "dry-run", dryRun,
+		"Log the section.io API requests of ban, ban.url and vcl.use instead of sending them.")
+
+	envBackend := os.Getenv(cliEnvKeyPrefix + "BACKEND")
+	if envBackend != "" {
+		backendName = envBackend
+	}
+	flag.StringVar(&backendName, "backend", backendName,
+		"The cache invalidation backend which bans and VCL are applied to, sectionio or relay.")
+
+	envRelayTargets := os.Getenv(cliEnvKeyPrefix + "RELAY_TARGETS")
+	if envRelayTargets != "" {
+		relayTargets = envRelayTargets
+	}
+	flag.StringVar(&relayTargets, "relay-targets", relayTargets,
+		"The varnishd admin addresses the relay backend forwards to, separated by commas, each optionally followed by =SECRETFILE.")
+
+	envRelayTargetsFile := os.Getenv(cliEnvKeyPrefix + "RELAY_TARGETS_FILE")
+	if envRelayTargetsFile != "" {
+		relayTargetsFile = envRelayTargetsFile
+	}
+	flag.StringVar(&relayTargetsFile, "relay-targets-file", relayTargetsFile,
+		"A JSON or YAML file of varnishd admin addresses for the relay backend, read again when it changes.")
+
+	envRelayTargetsDns := os.Getenv(cliEnvKeyPrefix + "RELAY_TARGETS_DNS")
+	if envRelayTargetsDns != "" {
+		relayTargetsDns = envRelayTargetsDns
+	}
+	flag.StringVar(&relayTargetsDns, "relay-targets-dns", relayTargetsDns,
+		"A DNS SRV name, or host:port resolved to A records, giving varnishd admin addresses for the relay backend.")
+
+	envRelayDiscoveryInterval := os.Getenv(cliEnvKeyPrefix + "RELAY_DISCOVERY_INTERVAL")
+	if envRelayDiscoveryInterval != "" {
+		parsed, err := time.ParseDuration(envRelayDiscoveryInterval)
+		if err != nil {
+			log.Fatal(cliEnvKeyPrefix + "RELAY_DISCOVERY_INTERVAL must be a duration like 30s.")
+		}
+		relayDiscoveryInterval = parsed
+	}
+	flag.DurationVar(&relayDiscoveryInterval, "relay-discovery-interval", relayDiscoveryInterval,
+		"How often relay targets are discovered again from the targets file and DNS.")
+
+	envRelaySecretFile := os.Getenv(cliEnvKeyPrefix + "RELAY_SECRET_FILE")
+	if envRelaySecretFile != "" {
+		relaySecretFile = envRelaySecretFile
+	}
+	flag.StringVar(&relaySecretFile, "relay-secret-file", relaySecretFile,
+		"The varnishd secret file the relay backend authenticates with.")
+
+	envUpstreamAddress := os.Getenv(cliEnvKeyPrefix + "UPSTREAM_ADDRESS")
+	if envUpstreamAddress != "" {
+		upstreamAddress = envUpstreamAddress
+	}
+	flag.StringVar(&upstreamAddress, "upstream-address", upstreamAddress,
+		"The admin address of a varnishd to which commands the bridge does not implement are passed through.")
+
+	envUpstreamSecretFile := os.Getenv(cliEnvKeyPrefix + "UPSTREAM_SECRET_FILE")
+	if envUpstreamSecretFile != "" {
+		upstreamSecretFile = envUpstreamSecretFile
+	}
+	flag.StringVar(&upstreamSecretFile, "upstream-secret-file", upstreamSecretFile,
+		"The secret file with which the bridge authenticates to the upstream varnishd.")
+
 	envApiEndpoint := os.Getenv(sectionioEnvKeyPrefix + "API_ENDPOINT")
 	if envApiEndpoint != "" {
-		parseApiEndpoint(envApiEndpoint, sectionioEnvKeyPrefix+"API_ENDPOINT is invalid")
+		sectionioApiEndpoints = envApiEndpoint
+	}
+	flag.StringVar(&sectionioApiEndpoints, "api-endpoint", sectionioApiEndpoints,
+		"The absolute section.io API url with account and application IDs, or several separated by commas.")
+
+	envApiFailurePolicy := os.Getenv(sectionioEnvKeyPrefix + "API_FAILURE_POLICY")
+	if envApiFailurePolicy != "" {
+		apiFailurePolicy = envApiFailurePolicy
 	}
-	flag.StringVar(&sectionioApiEndpointArgVal, "api-endpoint", sectionioApiEndpointArgVal,
-		"The absolute section.io API url with account and application IDs.")
+	flag.StringVar(&apiFailurePolicy, "api-failure-policy", apiFailurePolicy,
+		"Whether a request to several section.io targets fails if any target fails (all-or-nothing) or only if all do (best-effort).")
 
 	envUsername := os.Getenv(sectionioEnvKeyPrefix + "USERNAME")
 	if envUsername != "" {
@@ -141,36 +373,178 @@ func configure() {
 		os.Exit(1)
 	}
 
+	// checked by the section.io backend, the only one which uses it
 	sectionioPassword = os.Getenv(sectionioEnvKeyPrefix + "PASSWORD")
-	if sectionioPassword == "" {
-		log.Fatal(sectionioEnvKeyPrefix + "PASSWORD environment variable is required.")
-	}
 
-	if sectionioApiEndpointArgVal != "" {
-		parseApiEndpoint(sectionioApiEndpointArgVal, "api-endpoint argument is invalid.")
-	}
-	if sectionioUsername == "" {
-		log.Fatal("section.io username is required.")
-	}
 	if sectionioProxyName == "" {
 		log.Fatal("section.io proxy name is required.")
 	}
+	if apiFailurePolicy != apiFailurePolicyAllOrNothing && apiFailurePolicy != apiFailurePolicyBestEffort {
+		log.Fatal("API failure policy must be all-or-nothing or best-effort.")
+	}
 
-	if secretFile == "" {
-		log.Printf("Using no varnish secret file")
+	defaultListener := varnishCliListener{
+		ListenAddress:       listenAddress,
+		ManagementAddresses: managementAddresses,
+		HttpListenAddress:   httpListenAddress,
+		SecretFile:          secretFile,
+		Identity:            identity,
+		VarnishVersion:      varnishVersion,
+		BannerVersion:       bannerVarnishVersion,
+		ApiEndpoint:         sectionioApiEndpoints,
+		Backend:             backendName,
+		RelayTargets:        relayTargets,
+		RelayTargetsFile:    relayTargetsFile,
+		RelayTargetsDns:     relayTargetsDns,
+		RelaySecretFile:     relaySecretFile,
+		UpstreamAddress:     upstreamAddress,
+		UpstreamSecretFile:  upstreamSecretFile,
+	}
+	if listenersFile == "" {
+		listeners = []*varnishCliListener{&defaultListener}
 	} else {
-		log.Printf("Using Varnish CLI secret file '%s'.", secretFile)
+		log.Printf("Using listeners file '%s'.", listenersFile)
+		var err error
+		listeners, err = loadListeners(listenersFile, defaultListener)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, listener := range listeners {
+		err := listener.prepare()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Listener '%s' using listen address '%s'.", listener.Name, listener.ListenAddress)
+		for _, address := range parseManagementAddresses(listener.ManagementAddresses) {
+			log.Printf("Listener '%s' using management console address '%s'.", listener.Name, address)
+		}
+		if listener.HttpListenAddress != "" {
+			log.Printf("Listener '%s' using HTTP listen address '%s'.", listener.Name, listener.HttpListenAddress)
+		}
+		if listener.SecretFile == "" {
+			log.Printf("Listener '%s' using no varnish secret file", listener.Name)
+		} else {
+			log.Printf("Listener '%s' using Varnish CLI secret file '%s'.", listener.Name, listener.SecretFile)
+		}
+		if approverSecretFile != "" && listener.SecretFile == "" {
+			log.Fatal("A secret file is required when an approver secret file is set.")
+		}
+		log.Printf("Listener '%s' using backend '%s'.", listener.Name, listener.backend.Name())
+		if listener.upstream != nil {
+			log.Printf("Listener '%s' passing unimplemented commands through to '%s'.", listener.Name, listener.UpstreamAddress)
+		}
+		log.Printf("Listener '%s' using Varnish version '%s'.", listener.Name, listener.VarnishVersion)
+		log.Printf("Listener '%s' using Varnish banner version '%s'.", listener.Name, listener.BannerVersion)
 	}
 
-	if bannerVarnishVersion == "" {
-		bannerVarnishVersion = fmt.Sprintf("varnish-%s.0 revision 0000000", varnishVersion)
+	var err error
+	approverSecrets, err = parseApproverSecrets(approverSecretFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(approverSecrets) > 0 {
+		if vclApprovalTimeout <= 0 {
+			log.Fatal("VCL approval timeout must be positive.")
+		}
+		err = checkApproverSecrets(approverSecrets, listeners)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, secret := range approverSecrets {
+			log.Printf("Using approver secret file '%s' with identity '%s'.", secret.Path, secret.Identity)
+		}
+		log.Printf("Using vcl.use approval within %v.", vclApprovalTimeout)
 	}
 
-	log.Printf("Using API endpoint '%s'.", sectionioApiEndpoint)
-	log.Printf("Using API proxy name '%s'.", sectionioProxyName)
+	log.Printf("Using API failure policy '%s'.", apiFailurePolicy)
 	log.Printf("Using API username '%s'.", sectionioUsername)
-	log.Printf("Using Varnish version '%s'.", varnishVersion)
-	log.Printf("Using Varnish banner version '%s'.", bannerVarnishVersion)
+	if vclDirectory == "" {
+		log.Printf("Using no VCL directory, vcl.load is disabled.")
+	} else {
+		log.Printf("Using VCL directory '%s'.", vclDirectory)
+	}
+	if stateDirectory == "" {
+		log.Printf("Using no state directory, VCL configs will not survive a restart.")
+	} else {
+		log.Printf("Using state directory '%s'.", stateDirectory)
+		err = checkStateDirectory(stateDirectory)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, listener := range listeners {
+			err := listener.loadState(stateDirectory)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	err = loadVclPersonalityRules(vclPersonalityRulesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if vclPersonality != "" {
+		log.Printf("Using VCL personality '%s'.", vclPersonality)
+	} else {
+		for _, rule := range vclPersonalityRules {
+			log.Printf("Using VCL personality '%s' for VCL matching '%s'.", rule.Personality, rule.Pattern)
+		}
+	}
+	err = parseVclMessageTemplate(vclMessageTemplate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	httpBanMappingList, err = parseHttpBanMappings(httpBanMappings)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if maximumBanLength <= 0 {
+		log.Fatal("Maximum ban length must be positive.")
+	}
+	log.Printf("Using surrogate key field '%s' and maximum ban length %d.", surrogateKeyField, maximumBanLength)
+	for _, mapping := range httpBanMappingList {
+		log.Printf("Using HTTP ban mapping of header '%s' to '%s %s'.", mapping.Header, mapping.Field, mapping.Operator)
+	}
+	httpAllowedNetworks, err = parseHttpAllowedClients(httpAllowedClients)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(httpAllowedNetworks) == 0 {
+		log.Printf("Using HTTP frontend for any client.")
+	} else {
+		log.Printf("Using HTTP frontend for clients '%s'.", httpAllowedClients)
+	}
+	if httpTokenFile != "" {
+		httpToken, err = loadHttpToken(httpTokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Using HTTP token file '%s'.", httpTokenFile)
+	}
+	vclTransformPipeline, err = parseVclTransforms(vclTransforms)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, step := range vclTransformPipeline {
+		log.Printf("Using VCL transform '%s'.", step.Name)
+	}
+	if vclPolicyFile != "" {
+		vclDeployPolicy, err = loadVclPolicy(vclPolicyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Using VCL policy file '%s' in %s mode.", vclPolicyFile, vclDeployPolicy.Mode)
+	}
+	log.Printf("Using VCL message template '%s'.", vclMessageTemplate)
+
+	if vclShowDeployed {
+		log.Printf("Using deployed VCL for vcl.show of the active config.")
+	}
+	if dryRun {
+		log.Printf("Using dry-run mode, no changes will be sent to section.io.")
+	}
 }
 
 func main() {
@@ -178,22 +552,40 @@ func main() {
 
 	configure()
 
-	log.Printf("Listening on '%s'.", listenAddress)
-	listener, err := net.Listen("tcp", listenAddress)
-	if err != nil {
-		log.Fatal(err)
+	errs := make(chan error)
+	for _, listener := range listeners {
+		for _, address := range parseManagementAddresses(listener.ManagementAddresses) {
+			go serveManagementConsole(address, listener)
+		}
+		if listener.HttpListenAddress != "" {
+			go func(listener *varnishCliListener) {
+				errs <- serveHttpFrontend(listener)
+			}(listener)
+		}
+		if listener.ListenAddress == listenAddressNone {
+			continue
+		}
+		log.Printf("Listening on '%s'.", listener.ListenAddress)
+		netListener, err := net.Listen("tcp", listener.ListenAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func(listener *varnishCliListener) {
+			errs <- serveListener(netListener, listener)
+		}(listener)
 	}
+	log.Fatal(<-errs)
+}
 
+// serveListener accepts connections until the listener fails.
+func serveListener(netListener net.Listener, listener *varnishCliListener) error {
+	defer netListener.Close()
 	for {
-		connection, err := listener.Accept()
+		connection, err := netListener.Accept()
 		if err != nil {
-			log.Fatal(err) // panic instead?
+			return err
 		}
-		go handleConnection(connection)
-	}
-	err = listener.Close() // defer instead
-	if err != nil {
-		log.Fatal(err)
+		go handleConnection(connection, listener)
 	}
 }
 
@@ -205,11 +597,31 @@ func writeVarnishCliResponse(writer io.Writer, status VarnishCliResponseStatus,
 
 	_, err := writer.Write(buffer)
 	if err != nil {
-		log.Panic(err)
+		// the connection ends the session once the request is handled
+		log.Printf("Failed to send response %#v: %v", response, err)
+		return
 	}
 	log.Printf("Sent response %#v", response)
 }
 
+// varnishCliConnectionWriter remembers the first error writing to a CLI
+// connection, after which the session is ended and further writes fail.
+type varnishCliConnectionWriter struct {
+	connection net.Conn
+	err        error
+}
+
+func (writer *varnishCliConnectionWriter) Write(data []byte) (int, error) {
+	if writer.err != nil {
+		return 0, writer.err
+	}
+	count, err := writer.connection.Write(data)
+	if err != nil {
+		writer.err = err
+	}
+	return count, err
+}
+
 func handleRequest(requestLine string, session *varnishCliSession) {
 	log.Printf("Received request %#v", requestLine)
 	requestLine = strings.TrimLeft(requestLine, " ")
@@ -226,9 +638,12 @@ func handleRequest(requestLine string, session *varnishCliSession) {
 
 	switch command {
 	case "banner":
-		writeVarnishCliBanner(session.Writer)
+		writeVarnishCliBanner(session)
 		return
 	case "auth":
+		if !checkArgumentCount(commandAndArgs, 1, 1, session.Writer) {
+			return
+		}
 		handleVarnishCliAuthenticationAttempt(commandAndArgs[1], session)
 		return
 	case "ping":
@@ -236,9 +651,9 @@ func handleRequest(requestLine string, session *varnishCliSession) {
 		return
 	case "help":
 		if len(commandAndArgs) == 1 {
-			handleVarnishCliHelpRequest("", session.Writer)
+			handleVarnishCliHelpRequest("", session)
 		} else {
-			handleVarnishCliHelpRequest(commandAndArgs[1], session.Writer)
+			handleVarnishCliHelpRequest(commandAndArgs[1], session)
 		}
 		return
 	}
@@ -250,19 +665,149 @@ func handleRequest(requestLine string, session *varnishCliSession) {
 
 	switch command {
 	case "param.show":
-		handleVarnishCliParamShowRequest(commandAndArgs[1], session.Writer)
+		if !checkArgumentCount(commandAndArgs, 0, 2, session.Writer) {
+			return
+		}
+		// param.show [-l] [<param>]
+		param := optionalArgument(commandAndArgs, 1)
+		if param == "-l" {
+			param = optionalArgument(commandAndArgs, 2)
+		}
+		handleVarnishCliParamShowRequest(param, session)
 		return
 	case "ban":
-		handleVarnishCliBanRequest(varnishQuoteArgs(commandAndArgs[1:]), session.Writer)
+		handleVarnishCliBanRequest(varnishQuoteArgs(commandAndArgs[1:]), session)
 		return
 	case "ban.url":
-		handleVarnishCliBanRequest("req.url ~ "+commandAndArgs[1], session.Writer)
+		if !checkArgumentCount(commandAndArgs, 1, 1, session.Writer) {
+			return
+		}
+		handleVarnishCliBanRequest(varnishQuoteArgs([]string{"req.url", "~", commandAndArgs[1]}), session)
+		return
+	case "ban.list":
+		if !checkArgumentCount(commandAndArgs, 0, 0, session.Writer) {
+			return
+		}
+		handleVarnishCliBanList(session)
+		return
+	case "status":
+		if !checkArgumentCount(commandAndArgs, 0, 0, session.Writer) {
+			return
+		}
+		handleVarnishCliStatus(session)
 		return
 	case "vcl.inline":
-		handleVarnishCliVclInline(commandAndArgs[1], commandAndArgs[2], session.Writer)
+		if !checkArgumentCount(commandAndArgs, 2, session.Listener.maximumVclArgumentCount(2), session.Writer) {
+			return
+		}
+		handleVarnishCliVclInline(commandAndArgs[1], commandAndArgs[2], optionalArgument(commandAndArgs, 3), session)
+		return
+	case "vcl.load":
+		if !checkArgumentCount(commandAndArgs, 2, session.Listener.maximumVclArgumentCount(2), session.Writer) {
+			return
+		}
+		handleVarnishCliVclLoad(commandAndArgs[1], commandAndArgs[2], optionalArgument(commandAndArgs, 3), session)
 		return
 	case "vcl.use":
-		handleVarnishCliVclUse(commandAndArgs[1], session.Writer)
+		if !checkArgumentCount(commandAndArgs, 1, 1, session.Writer) {
+			return
+		}
+		handleVarnishCliVclUse(commandAndArgs[1], session)
+		return
+	case "vcl.discard":
+		if !checkArgumentCount(commandAndArgs, 1, 1, session.Writer) {
+			return
+		}
+		handleVarnishCliVclDiscard(commandAndArgs[1], session)
+		return
+	case "vcl.state":
+		if !session.Listener.varnishVersionAtLeast(4, 1) {
+			break
+		}
+		if !checkArgumentCount(commandAndArgs, 2, 2, session.Writer) {
+			return
+		}
+		handleVarnishCliVclState(commandAndArgs[1], commandAndArgs[2], session)
+		return
+	case "vcl.label":
+		if !session.Listener.varnishVersionAtLeast(5, 0) {
+			break
+		}
+		if !checkArgumentCount(commandAndArgs, 2, 2, session.Writer) {
+			return
+		}
+		handleVarnishCliVclLabel(commandAndArgs[1], commandAndArgs[2], session)
+		return
+	case "vcl.list":
+		handleVarnishCliVclList(commandAndArgs[1:], session)
+		return
+	case "vcl.diff":
+		if !checkArgumentCount(commandAndArgs, 1, 1, session.Writer) {
+			return
+		}
+		handleVarnishCliVclDiff(commandAndArgs[1], session)
+		return
+	case "vcl.history":
+		if !checkArgumentCount(commandAndArgs, 0, 0, session.Writer) {
+			return
+		}
+		handleVarnishCliVclHistory(session)
+		return
+	case "vcl.rollback":
+		if !checkArgumentCount(commandAndArgs, 1, 1, session.Writer) {
+			return
+		}
+		handleVarnishCliVclRollback(commandAndArgs[1], session)
+		return
+	case "vcl.pending":
+		if !checkArgumentCount(commandAndArgs, 0, 0, session.Writer) {
+			return
+		}
+		handleVarnishCliVclPending(session)
+		return
+	case "vcl.approve":
+		if !checkArgumentCount(commandAndArgs, 1, 1, session.Writer) {
+			return
+		}
+		handleVarnishCliVclApprove(commandAndArgs[1], session)
+		return
+	case "vcl.reject":
+		if !checkArgumentCount(commandAndArgs, 1, 1, session.Writer) {
+			return
+		}
+		handleVarnishCliVclReject(commandAndArgs[1], session)
+		return
+	case "purge.keys":
+		if !checkArgumentCount(commandAndArgs, 1, len(commandAndArgs), session.Writer) {
+			return
+		}
+		handleVarnishCliPurgeKeys(commandAndArgs[1:], session)
+		return
+	case "relay.targets":
+		if !checkArgumentCount(commandAndArgs, 0, 0, session.Writer) {
+			return
+		}
+		handleVarnishCliRelayTargets(session)
+		return
+	case "bridge.dry_run":
+		if !checkArgumentCount(commandAndArgs, 0, 1, session.Writer) {
+			return
+		}
+		handleVarnishCliBridgeDryRun(optionalArgument(commandAndArgs, 1), session)
+		return
+	case "vcl.preview":
+		if !checkArgumentCount(commandAndArgs, 1, 1, session.Writer) {
+			return
+		}
+		handleVarnishCliVclPreview(commandAndArgs[1], session)
+		return
+	case "vcl.show":
+		handleVarnishCliVclShow(commandAndArgs[1:], session)
+		return
+	}
+
+	if session.Listener.upstream != nil {
+		handleVarnishCliPassthrough(requestLine, session)
 		return
 	}
 
@@ -270,25 +815,62 @@ func handleRequest(requestLine string, session *varnishCliSession) {
 	writeVarnishCliResponse(session.Writer, CLIS_UNIMPL, "Unimplemented")
 }
 
-func handleConnection(connection net.Conn) {
+// checkArgumentCount responds as varnishd does when a command has too few or
+// too many arguments, returning false in that case.
+func checkArgumentCount(commandAndArgs []string, minimum int, maximum int, writer io.Writer) bool {
+	argumentCount := len(commandAndArgs) - 1
+	if argumentCount < minimum {
+		writeVarnishCliResponse(writer, CLIS_TOOFEW, "Too few parameters")
+		return false
+	}
+	if argumentCount > maximum {
+		writeVarnishCliResponse(writer, CLIS_TOOMANY, "Too many parameters")
+		return false
+	}
+	return true
+}
+
+func optionalArgument(commandAndArgs []string, index int) string {
+	if index < len(commandAndArgs) {
+		return commandAndArgs[index]
+	}
+	return ""
+}
+
+func handleConnection(connection net.Conn, listener *varnishCliListener) {
 	defer connection.Close()
 	scanner := bufio.NewScanner(connection)
+	writer := &varnishCliConnectionWriter{connection: connection}
+
+	session := &varnishCliSession{
+		Writer:           writer,
+		HasAuthenticated: listener.SecretFile == "",
+		RemoteAddress:    connection.RemoteAddr().String(),
+		DryRun:           dryRun,
+		Listener:         listener,
+	}
 
-	session := &varnishCliSession{connection, secretFile == "", ""}
+	if session.HasAuthenticated {
+		session.Identity = "anonymous"
+	}
 
 	if !session.HasAuthenticated {
 		writeVarnishCliAuthenticationChallenge(session)
 	} else {
-		writeVarnishCliBanner(session.Writer)
+		writeVarnishCliBanner(session)
 	}
 
-	for {
+	for writer.err == nil {
 		if scanner.Scan() {
 			handleRequest(scanner.Text(), session)
 		} else {
 			break
 		}
 	}
+	if writer.err != nil {
+		log.Printf("Closing connection from '%s' after failing to respond: %v", session.RemoteAddress, writer.err)
+		return
+	}
 
 	err := scanner.Err()
 	if err != nil {
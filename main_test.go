@@ -19,7 +19,7 @@ func TestCliResponseStatusLineLengthFieldIsLeftAligned(t *testing.T) {
 
 func TestAuthenticationChallengeIsRemembered(t *testing.T) {
 	mockWriter := new(bytes.Buffer)
-	mockSession := &varnishCliSession{mockWriter, false, ""}
+	mockSession := &varnishCliSession{Writer: mockWriter}
 	writeVarnishCliAuthenticationChallenge(mockSession)
 	response := mockWriter.String()
 	fields := strings.Fields(response)
@@ -45,7 +45,7 @@ func TestCalculatedAuthenticator(t *testing.T) {
 	authenticator := "455ce847f0073c7ab3b1465f74507b75d3dc064c1e7de3b71e00de9092fdc89a"
 
 	mockWriter := new(bytes.Buffer)
-	mockSession := &varnishCliSession{mockWriter, false, authChallenge}
+	mockSession := &varnishCliSession{Writer: mockWriter, AuthChallenge: authChallenge, Listener: newTestListener("3.0")}
 
 	handleVarnishCliAuthenticationAttemptInternal(authenticator, mockSession, secretBytes)
 	response := mockWriter.String()
@@ -57,3 +57,89 @@ func TestCalculatedAuthenticator(t *testing.T) {
 		t.Errorf("Expected session to become authenticated but was not.")
 	}
 }
+
+func TestVclMessageTemplateRendersDeploymentFields(t *testing.T) {
+	defer func(previous string) { version = previous }(version)
+	version = "1.2.3"
+	err := parseVclMessageTemplate("{{.ConfigName}} by {{.Identity}} from {{.ClientAddress}} with {{.Version}} ({{.ContentHash}})")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parseVclMessageTemplate("Update")
+
+	backend := &fakeBackend{}
+	listener := newTestListener("4.0")
+	listener.backend = backend
+	listener.configs.add(vclConfig{Name: "boot", Source: "vcl 4.0;", Personality: "Varnish4"})
+	session := &varnishCliSession{Writer: new(bytes.Buffer), Identity: "ops", RemoteAddress: "192.0.2.1:50000", Listener: listener}
+	handleVarnishCliVclUse("boot", session)
+
+	// sha256 of "vcl 4.0;"
+	expected := "boot by ops from 192.0.2.1:50000 with 1.2.3 (803ab3333ac13b0c22a86d3eae5878969f3a19cd4f382f6260ddf71028ae8cbd)"
+	if len(backend.deploys) != 1 || backend.deploys[0].Message != expected {
+		t.Errorf("Expected the message %#v but deployed %#v.", expected, backend.deploys)
+	}
+
+	if err := parseVclMessageTemplate("{{.Unknown"); err == nil {
+		t.Errorf("Expected an invalid template to be refused.")
+	}
+}
+
+func TestVclPersonalityOverridesDetection(t *testing.T) {
+	defer func(previous string) { vclPersonality = previous }(vclPersonality)
+	vclPersonality = "Custom"
+	parseVclMessageTemplate("Update")
+
+	backend := &fakeBackend{}
+	listener := newTestListener("4.0")
+	listener.backend = backend
+	session := &varnishCliSession{Writer: new(bytes.Buffer), Listener: listener}
+	handleVarnishCliVclInline("boot", "vcl 4.0;\nbackend default { .host = \"127.0.0.1\"; }", "", session)
+	handleVarnishCliVclUse("boot", session)
+	if len(backend.deploys) != 1 || backend.deploys[0].Personality != "Custom" {
+		t.Errorf("Expected the VCL to be deployed with the configured personality but was %#v.", backend.deploys)
+	}
+}
+
+func TestIdentityNamesSecretFile(t *testing.T) {
+	listener := newTestListener("3.0")
+	listener.SecretFile = "/etc/varnish/secret"
+	if identity := listener.secretIdentity(); identity != "/etc/varnish/secret" {
+		t.Errorf("Expected the identity to default to the path of the file but was %#v.", identity)
+	}
+	listener.Identity = "deploy-bot"
+	if identity := listener.secretIdentity(); identity != "deploy-bot" {
+		t.Errorf("Expected the configured identity but was %#v.", identity)
+	}
+}
+
+func TestCommandsWithoutArgumentsAreRefused(t *testing.T) {
+	for _, command := range []string{"auth", "ban.url", "param.show a b c"} {
+		mockWriter := new(bytes.Buffer)
+		session := &varnishCliSession{Writer: mockWriter, HasAuthenticated: command != "auth", Listener: newTestListener("4.0")}
+		handleRequest(command, session)
+		if actual := mockWriter.String(); !strings.HasPrefix(actual, "104 ") && !strings.HasPrefix(actual, "105 ") {
+			t.Errorf("Expected %#v to be refused for its parameters but was %#v.", command, actual)
+		}
+	}
+
+	mockWriter := new(bytes.Buffer)
+	handleRequest("param.show -l cli_buffer", &varnishCliSession{Writer: mockWriter, HasAuthenticated: true, Listener: newTestListener("4.0")})
+	if actual := mockWriter.String(); !strings.HasPrefix(actual, "200 ") {
+		t.Errorf("Expected param.show -l to show the parameter but was %#v.", actual)
+	}
+}
+
+func TestHelpListsCommandsOfVarnishVersion(t *testing.T) {
+	for _, varnishVersion := range []string{"4.0", "4.1", "5.0"} {
+		mockWriter := new(bytes.Buffer)
+		handleRequest("help", &varnishCliSession{Writer: mockWriter, Listener: newTestListener(varnishVersion)})
+		actual := mockWriter.String()
+		if hasState := strings.Contains(actual, "vcl.state "); hasState != (varnishVersion != "4.0") {
+			t.Errorf("Expected vcl.state to be listed for %s only from 4.1 but was %#v.", varnishVersion, actual)
+		}
+		if hasLabel := strings.Contains(actual, "vcl.label "); hasLabel != (varnishVersion == "5.0") {
+			t.Errorf("Expected vcl.label to be listed for %s only from 5.0 but was %#v.", varnishVersion, actual)
+		}
+	}
+}
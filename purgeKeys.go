@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+var (
+	surrogateKeyField = "obj.http.xkey"
+	// maximumBanLength leaves room within the 8k default cli_buffer of
+	// varnishd for the rest of the command.
+	maximumBanLength = 4096
+)
+
+var surrogateKeySeparatorRx = regexp.MustCompile(`[\s,]+`)
+
+// splitSurrogateKeys splits a header value listing keys separated by
+// whitespace or commas.
+func splitSurrogateKeys(value string) []string {
+	keys := []string{}
+	for _, key := range surrogateKeySeparatorRx.Split(value, -1) {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// surrogateKeyBan is a ban expression matching objects tagged with any of the
+// keys, in a field which lists keys separated by whitespace or commas.
+func surrogateKeyBan(keys []string) string {
+	quoted := make([]string, len(keys))
+	for index, key := range keys {
+		quoted[index] = regexp.QuoteMeta(key)
+	}
+	pattern := `(^|[\s,])(` + strings.Join(quoted, "|") + `)($|[\s,])`
+	return varnishQuoteArgs([]string{surrogateKeyField, "~", pattern})
+}
+
+// surrogateKeyBans groups the keys into as few ban expressions as fit within
+// the maximum ban length.
+func surrogateKeyBans(keys []string) ([]string, error) {
+	bans := []string{}
+	group := []string{}
+	for _, key := range keys {
+		if key == "" || surrogateKeySeparatorRx.MatchString(key) {
+			return nil, fmt.Errorf("Surrogate key %q is empty or contains a separator.", key)
+		}
+		if len(surrogateKeyBan([]string{key})) > maximumBanLength {
+			return nil, fmt.Errorf("Surrogate key %q is too long for a ban.", key)
+		}
+		if len(group) > 0 && len(surrogateKeyBan(append(group, key))) > maximumBanLength {
+			bans = append(bans, surrogateKeyBan(group))
+			group = []string{}
+		}
+		group = append(group, key)
+	}
+	if len(group) > 0 {
+		bans = append(bans, surrogateKeyBan(group))
+	}
+	return bans, nil
+}
+
+// purgeKeys bans objects tagged with any of the surrogate keys, in several
+// bans when the keys do not fit in one. It stops at the first ban which
+// fails, returning the CLI status and response describing the outcome.
+func purgeKeys(keys []string, session *varnishCliSession) (VarnishCliResponseStatus, string) {
+	bans, err := surrogateKeyBans(keys)
+	if err != nil {
+		return CLIS_PARAM, err.Error()
+	}
+	if len(bans) == 0 {
+		return CLIS_PARAM, "No surrogate keys given."
+	}
+
+	for index, ban := range bans {
+		log.Printf("Purging surrogate keys, ban %d of %d: %s", index+1, len(bans), ban)
+		status, response := applyBan(ban, session)
+		if status != CLIS_OK {
+			return status, joinResponseLines(fmt.Sprintf("Ban %d of %d failed, the bans before it were forwarded.", index+1, len(bans)), response)
+		}
+	}
+	return CLIS_OK, fmt.Sprintf("Purged %d surrogate keys in %d bans.", len(keys), len(bans))
+}
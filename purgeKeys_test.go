@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSurrogateKeyBanIsEscaped(t *testing.T) {
+	ban := surrogateKeyBan([]string{"product.1+2", "cat[3]"})
+	tokens := tokenizeRequest(ban)
+	if len(tokens) != 3 || tokens[0] != "obj.http.xkey" || tokens[1] != "~" {
+		t.Fatalf("Unexpected ban tokens %#v.", tokens)
+	}
+	pattern := regexp.MustCompile(tokens[2])
+	for _, value := range []string{"product.1+2", "home product.1+2 footer", "a,cat[3]"} {
+		if !pattern.MatchString(value) {
+			t.Errorf("Expected %#v to match %s.", value, tokens[2])
+		}
+	}
+	for _, value := range []string{"productX1+2", "product.1+23", "cat3", "xcat[3]"} {
+		if pattern.MatchString(value) {
+			t.Errorf("Expected %#v not to match %s.", value, tokens[2])
+		}
+	}
+}
+
+func TestSurrogateKeysAreSplitAcrossBans(t *testing.T) {
+	defer func(previous int) { maximumBanLength = previous }(maximumBanLength)
+	maximumBanLength = len(surrogateKeyBan([]string{"key-01", "key-02", "key-03"}))
+
+	bans, err := surrogateKeyBans(strings.Fields("key-01 key-02 key-03 key-04 key-05 key-06 key-07"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 3 {
+		t.Fatalf("Expected 3 bans but was %#v.", bans)
+	}
+	for _, ban := range bans {
+		if len(ban) > maximumBanLength {
+			t.Errorf("Expected at most %d bytes but was %d: %s", maximumBanLength, len(ban), ban)
+		}
+	}
+	if !strings.Contains(bans[2], "key-07") || strings.Contains(bans[2], "key-06") {
+		t.Errorf("Expected the last ban to hold the last key only but was %s.", bans[2])
+	}
+
+	maximumBanLength = 10
+	if _, err := surrogateKeyBans([]string{"key-01"}); err == nil {
+		t.Errorf("Expected a key too long for a ban to be refused.")
+	}
+}
+
+func TestPurgeKeysCommandAndHttpHeader(t *testing.T) {
+	backend := &fakeBackend{}
+	listener := newTestListener("4.1")
+	listener.backend = backend
+
+	mockWriter := new(bytes.Buffer)
+	session := &varnishCliSession{Writer: mockWriter, HasAuthenticated: true, Listener: listener}
+	handleRequest(`purge.keys product-1 category-2`, session)
+	if actual := mockWriter.String(); !strings.HasPrefix(actual, "200 ") || !strings.Contains(actual, "Purged 2 surrogate keys in 1 bans.") {
+		t.Errorf("Unexpected response %#v.", actual)
+	}
+
+	mockWriter.Reset()
+	handleRequest(`purge.keys`, session)
+	if actual := mockWriter.String(); !strings.HasPrefix(actual, "104 ") {
+		t.Errorf("Expected purge.keys without keys to be refused but was %#v.", actual)
+	}
+
+	server := httptest.NewServer(&httpBanHandler{Listener: listener})
+	defer server.Close()
+	request, _ := http.NewRequest("PURGE", server.URL+"/", nil)
+	request.Header.Set("Xkey-Purge", "product-1, category-2")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 but was %d.", response.StatusCode)
+	}
+
+	if len(backend.bans) != 2 || backend.bans[0] != backend.bans[1] {
+		t.Errorf("Expected the command and the header to ban alike but was %#v.", backend.bans)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// relayBackend forwards bans and VCL to self-hosted varnishd instances over
+// their CLI admin ports. Its targets are those configured statically followed
+// by those found by discovery, which may change at any time.
+type relayBackend struct {
+	static []*varnishCliPool
+
+	mutex   sync.Mutex
+	targets []*varnishCliPool
+	// loaded holds the names of the VCL this backend loaded into each target,
+	// by the key of the target, so that only those are discarded
+	loaded map[string]map[string]bool
+}
+
+var relayVclNameRx = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// parseRelayTargets parses a comma-separated list of varnishd admin addresses,
+// each optionally followed by '=' and the path of its own secret file.
+func parseRelayTargets(relayTargets string, secretFile string) ([]*varnishCliPool, error) {
+	targets := []*varnishCliPool{}
+	for _, entry := range strings.Split(relayTargets, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		target := &varnishCliPool{Address: entry, SecretFile: secretFile}
+		if index := strings.Index(entry, "="); index >= 0 {
+			target.Address = entry[:index]
+			target.SecretFile = entry[index+1:]
+		}
+		if target.Address == "" {
+			return nil, fmt.Errorf("Relay target '%s' has no address.", entry)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+func newRelayBackend(listener *varnishCliListener) (*relayBackend, error) {
+	static, err := parseRelayTargets(listener.RelayTargets, listener.RelaySecretFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range static {
+		target.Source = "static"
+		log.Printf("Using relay target '%s'.", target.Address)
+	}
+	backend := &relayBackend{static: static, targets: static}
+
+	discovery := &relayDiscovery{SecretFile: listener.RelaySecretFile, Interval: relayDiscoveryInterval}
+	if listener.RelayTargetsFile != "" {
+		discovery.Sources = append(discovery.Sources, &relayFileSource{Path: listener.RelayTargetsFile})
+	}
+	if listener.RelayTargetsDns != "" {
+		discovery.Sources = append(discovery.Sources, &relayDnsSource{Name: listener.RelayTargetsDns})
+	}
+	if len(discovery.Sources) == 0 {
+		if len(static) == 0 {
+			return nil, fmt.Errorf("at least one relay target is required.")
+		}
+		return backend, nil
+	}
+
+	if discovery.Interval <= 0 {
+		return nil, fmt.Errorf("relay discovery interval must be positive.")
+	}
+	discovered, err := discovery.refresh()
+	if err != nil {
+		return nil, err
+	}
+	backend.setDiscoveredTargets(discovered)
+	for _, source := range discovery.Sources {
+		log.Printf("Discovering relay targets from %s every %v.", source, discovery.Interval)
+	}
+	go discovery.watch(backend)
+	return backend, nil
+}
+
+// setDiscoveredTargets replaces the discovered targets, keeping the pooled
+// connections of those which remain and closing those of the others.
+func (backend *relayBackend) setDiscoveredTargets(discovered []*varnishCliPool) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	current := map[string]*varnishCliPool{}
+	for _, target := range backend.targets {
+		current[target.key()] = target
+	}
+	targets := append([]*varnishCliPool{}, backend.static...)
+	kept := map[string]bool{}
+	for _, target := range backend.static {
+		kept[target.key()] = true
+	}
+	for _, target := range discovered {
+		key := target.key()
+		if kept[key] {
+			continue
+		}
+		kept[key] = true
+		if existing, ok := current[key]; ok {
+			targets = append(targets, existing)
+		} else {
+			log.Printf("Adding relay target '%s' from %s.", target.Address, target.Source)
+			targets = append(targets, target)
+		}
+	}
+	for key, target := range current {
+		if !kept[key] {
+			log.Printf("Removing relay target '%s' from %s.", target.Address, target.Source)
+			target.close()
+		}
+	}
+	backend.targets = targets
+}
+
+// currentTargets returns the targets at the time of the call.
+func (backend *relayBackend) currentTargets() ([]*varnishCliPool, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if len(backend.targets) == 0 {
+		return nil, fmt.Errorf("No relay targets are known.")
+	}
+	return backend.targets, nil
+}
+
+func (backend *relayBackend) Name() string {
+	return relayBackendName
+}
+
+// relayCommand sends a command to one varnishd, or only logs it in dry-run
+// mode.
+func relayCommand(target *varnishCliPool, command string, dryRun bool) (string, error) {
+	if dryRun {
+		log.Printf("Dry run, not sending to '%s': %s", target.Address, command)
+		return "", nil
+	}
+	return target.command(command)
+}
+
+// relayTargetList returns the targets for the helpers shared between
+// backends.
+func relayTargetList(targets []*varnishCliPool) []fmt.Stringer {
+	list := make([]fmt.Stringer, len(targets))
+	for index, target := range targets {
+		list[index] = target
+	}
+	return list
+}
+
+func (backend *relayBackend) ApplyBan(expression string, dryRun bool) backendResult {
+	targets, err := backend.currentTargets()
+	if err != nil {
+		return backendResult{Summary: err.Error()}
+	}
+	results := callBackendTargets(relayTargetList(targets), func(target fmt.Stringer) backendTargetResult {
+		_, err := relayCommand(target.(*varnishCliPool), "ban "+expression, dryRun)
+		return backendTargetResult{Err: err}
+	})
+	return backendResult{
+		OK:      backendTargetsSucceeded(results),
+		Summary: formatBackendTargetResults(results),
+	}
+}
+
+// relayVclName names VCL on varnishd after its config and content, so that
+// deploying the same content again reuses the loaded VCL.
+func relayVclName(configName string, content string) string {
+	contentHash := sha256.Sum256([]byte(content))
+	return fmt.Sprintf("bridge-%s-%s", relayVclNameRx.ReplaceAllString(configName, "_"), hex.EncodeToString(contentHash[:4]))
+}
+
+// useRelayVcl loads VCL into one varnishd, unless it was loaded before, and
+// makes it active. The VCL this backend loaded by earlier deployments is then
+// discarded.
+func (backend *relayBackend) useRelayVcl(target *varnishCliPool, name string, content string, dryRun bool) (string, error) {
+	_, err := relayCommand(target, "vcl.inline "+varnishQuoteArgs([]string{name, content}), dryRun)
+	loaded := err == nil
+	if cliErr, ok := err.(*varnishCliError); ok && cliErr.Status == CLIS_PARAM && strings.Contains(cliErr.Body, "Already") {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if loaded && !dryRun {
+		backend.setLoaded(target, name, true)
+	}
+	body, err := relayCommand(target, "vcl.use "+name, dryRun)
+	if err != nil {
+		return "", err
+	}
+	if !dryRun {
+		backend.discardLoadedVcl(target, name)
+	}
+	return body, nil
+}
+
+func (backend *relayBackend) setLoaded(target *varnishCliPool, name string, loaded bool) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	if backend.loaded == nil {
+		backend.loaded = map[string]map[string]bool{}
+	}
+	names := backend.loaded[target.key()]
+	if names == nil {
+		names = map[string]bool{}
+		backend.loaded[target.key()] = names
+	}
+	if loaded {
+		names[name] = true
+	} else {
+		delete(names, name)
+	}
+}
+
+// discardLoadedVcl discards the VCL this backend loaded into one varnishd,
+// other than the active one, so that deployments do not pile up warm VCL.
+// VCL loaded by other listeners or bridges sharing the varnishd is left
+// alone. Failures are only logged since the deployment itself succeeded, and
+// the VCL is tried again after the next deployment.
+func (backend *relayBackend) discardLoadedVcl(target *varnishCliPool, active string) {
+	backend.mutex.Lock()
+	names := []string{}
+	for name := range backend.loaded[target.key()] {
+		if name != active {
+			names = append(names, name)
+		}
+	}
+	backend.mutex.Unlock()
+
+	for _, name := range names {
+		_, err := target.command("vcl.discard " + name)
+		if cliErr, ok := err.(*varnishCliError); ok && cliErr.Status == CLIS_PARAM && strings.Contains(cliErr.Body, "No configuration named") {
+			err = nil
+		}
+		if err != nil {
+			log.Printf("Failed to discard VCL '%s' on '%s': %v", name, target.Address, err)
+			continue
+		}
+		backend.setLoaded(target, name, false)
+	}
+}
+
+func (backend *relayBackend) DeployVcl(request vclDeployRequest, dryRun bool) backendResult {
+	targets, err := backend.currentTargets()
+	if err != nil {
+		return backendResult{Summary: err.Error()}
+	}
+	return deployVclToBackendTargets(relayTargetList(targets), request, func(target fmt.Stringer, request vclDeployRequest) backendTargetResult {
+		name := relayVclName(request.ConfigName, request.Content)
+		log.Printf("Relaying VCL '%s' as '%s' to '%s': %s", request.ConfigName, name, target, request.Message)
+		_, err := backend.useRelayVcl(target.(*varnishCliPool), name, request.Content, dryRun)
+		return backendTargetResult{Response: map[string]interface{}{"vclName": name}, Err: err}
+	})
+}
+
+// DeployedVcl shows the active VCL of the first target, whose VCL the others
+// are expected to match.
+func (backend *relayBackend) DeployedVcl() (string, error) {
+	targets, err := backend.currentTargets()
+	if err != nil {
+		return "", err
+	}
+	target := targets[0]
+	list, err := target.command("vcl.list")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(list, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[0] == "active" {
+			return target.command("vcl.show " + fields[len(fields)-1])
+		}
+	}
+	return "", fmt.Errorf("No VCL is active on '%s'.", target.Address)
+}
+
+// ListBans lists the bans of the first target.
+func (backend *relayBackend) ListBans() (string, error) {
+	targets, err := backend.currentTargets()
+	if err != nil {
+		return "", err
+	}
+	bans, err := targets[0].command("ban.list")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(bans, "Present bans:\n"), nil
+}
+
+// Status reports the child status of every target.
+func (backend *relayBackend) Status() (string, error) {
+	targets, err := backend.currentTargets()
+	if err != nil {
+		return "", err
+	}
+	results := callBackendTargets(relayTargetList(targets), func(target fmt.Stringer) backendTargetResult {
+		body, err := target.(*varnishCliPool).command("status")
+		return backendTargetResult{Body: body, Err: err}
+	})
+	return backendTargetStatus(results)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startTestVarnishd serves the CLI of the bridge itself as a stand-in for
+// varnishd, applying what it receives to a fake backend.
+func startTestVarnishd(t *testing.T, secretFile string) (string, *fakeBackend) {
+	netListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &fakeBackend{}
+	listener := newTestListener("4.0")
+	listener.SecretFile = secretFile
+	listener.backend = backend
+	go serveListener(netListener, listener)
+	return netListener.Addr().String(), backend
+}
+
+func writeTestSecret(t *testing.T, directory string, name string, secret string) string {
+	path := filepath.Join(directory, name)
+	err := ioutil.WriteFile(path, []byte(secret), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRelayBackendForwardsToEveryInstance(t *testing.T) {
+	defer func(previous string) { vclPersonality = previous }(vclPersonality)
+	vclPersonality = "Varnish4"
+	parseVclMessageTemplate("Update")
+	directory, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	firstSecret := writeTestSecret(t, directory, "first", "first secret\n")
+	secondSecret := writeTestSecret(t, directory, "second", "second secret\n")
+	firstAddress, first := startTestVarnishd(t, firstSecret)
+	secondAddress, second := startTestVarnishd(t, secondSecret)
+
+	backend, err := newRelayBackend(&varnishCliListener{RelayTargets: firstAddress + ", " + secondAddress + "=" + secondSecret, RelaySecretFile: firstSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := backend.ApplyBan(`"req.url" "~" "/images/"`, false)
+	if !result.OK || !strings.Contains(result.Summary, firstAddress+": OK") || !strings.Contains(result.Summary, secondAddress+": OK") {
+		t.Errorf("Expected the ban to succeed on both instances but was %#v.", result)
+	}
+	for _, instance := range []*fakeBackend{first, second} {
+		if len(instance.bans) != 1 || instance.bans[0] != `"req.url" "~" "/images/"` {
+			t.Errorf("Expected the ban to be relayed but was %#v.", instance.bans)
+		}
+	}
+
+	content := "vcl 4.0;\nsub vcl_recv {\n\treturn (pass);\n}\n"
+	for attempt := 0; attempt < 2; attempt++ {
+		result = backend.DeployVcl(vclDeployRequest{ConfigName: "main", Content: content}, false)
+		if !result.OK {
+			t.Errorf("Expected the VCL to be deployed on attempt %d but was %#v.", attempt, result)
+		}
+	}
+	// the second attempt reuses the loaded VCL, which the stand-in skips as identical
+	if len(first.deploys) != 1 || first.deploys[0].Content != content || first.deploys[0].ConfigName != relayVclName("main", content) {
+		t.Errorf("Expected the VCL to be deployed once but was %#v.", first.deploys)
+	}
+
+	// a pooled connection closed by varnishd is replaced transparently
+	for _, client := range backend.targets[0].idle {
+		client.connection.Close()
+	}
+	result = backend.ApplyBan(`"req.url" "~" "/css/"`, false)
+	if !result.OK || len(first.bans) != 2 {
+		t.Errorf("Expected the ban to be relayed on a new connection but was %#v.", result)
+	}
+
+	status, err := backend.Status()
+	if err != nil || !strings.Contains(status, firstAddress+": Child in state running") {
+		t.Errorf("Expected the status of each instance but was %#v, %v.", status, err)
+	}
+}
+
+func TestRelayBackendReportsAuthenticationFailure(t *testing.T) {
+	defer func(previous string) { apiFailurePolicy = previous }(apiFailurePolicy)
+	directory, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	goodSecret := writeTestSecret(t, directory, "good", "good secret\n")
+	wrongSecret := writeTestSecret(t, directory, "wrong", "wrong secret\n")
+	goodAddress, good := startTestVarnishd(t, goodSecret)
+	badAddress, _ := startTestVarnishd(t, goodSecret)
+
+	backend, err := newRelayBackend(&varnishCliListener{RelayTargets: goodAddress + "," + badAddress + "=" + wrongSecret, RelaySecretFile: goodSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apiFailurePolicy = apiFailurePolicyAllOrNothing
+	result := backend.ApplyBan(`"req.url" "~" "/"`, false)
+	if result.OK || !strings.Contains(result.Summary, badAddress+": 107 ") {
+		t.Errorf("Expected the ban to fail with the challenge of the instance but was %#v.", result)
+	}
+
+	apiFailurePolicy = apiFailurePolicyBestEffort
+	result = backend.ApplyBan(`"req.url" "~" "/"`, false)
+	if !result.OK || len(good.bans) != 2 {
+		t.Errorf("Expected the ban to succeed on the reachable instance but was %#v.", result)
+	}
+}
+
+func TestParseRelayTargets(t *testing.T) {
+	targets, err := parseRelayTargets("10.0.0.1:6082, 10.0.0.2:6082=/etc/varnish/other", "/etc/varnish/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[0].SecretFile != "/etc/varnish/secret" || targets[1].Address != "10.0.0.2:6082" || targets[1].SecretFile != "/etc/varnish/other" {
+		t.Errorf("Unexpected targets %#v.", targets)
+	}
+}
+
+func TestRelayBackendDiscardsPreviousVcl(t *testing.T) {
+	defer func(previous string) { vclPersonality = previous }(vclPersonality)
+	vclPersonality = "Varnish4"
+	parseVclMessageTemplate("Update")
+	directory, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	secret := writeTestSecret(t, directory, "secret", "secret\n")
+	address, _ := startTestVarnishd(t, secret)
+	backend, err := newRelayBackend(&varnishCliListener{RelayTargets: address, RelaySecretFile: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// as loaded by another bridge sharing the varnishd
+	other := relayVclName("other", "vcl 4.0;")
+	if _, err := backend.targets[0].command("vcl.inline " + varnishQuoteArgs([]string{other, "vcl 4.0;"})); err != nil {
+		t.Fatal(err)
+	}
+
+	first := "vcl 4.0;\nsub vcl_recv {\n\treturn (pass);\n}\n"
+	second := "vcl 4.0;\nsub vcl_recv {\n\treturn (hash);\n}\n"
+	for _, content := range []string{first, second} {
+		if result := backend.DeployVcl(vclDeployRequest{ConfigName: "main", Content: content}, false); !result.OK {
+			t.Fatalf("Expected the VCL to be deployed but was %#v.", result)
+		}
+	}
+
+	list, err := backend.targets[0].command("vcl.list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(list, relayVclName("main", first)) || !strings.Contains(list, relayVclName("main", second)) {
+		t.Errorf("Expected only the active VCL to remain loaded but was %#v.", list)
+	}
+	if !strings.Contains(list, other) {
+		t.Errorf("Expected VCL loaded by others to be kept but was %#v.", list)
+	}
+}
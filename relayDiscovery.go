@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// relayTargetSource discovers varnishd admin addresses for the relay backend.
+type relayTargetSource interface {
+	String() string
+	// discover returns the current targets, with secretFile for those which
+	// do not name their own.
+	discover(secretFile string) ([]*varnishCliPool, error)
+}
+
+// relayTargetEntry is a target listed in a targets file, either as an object
+// or as just its address.
+type relayTargetEntry struct {
+	Address    string `json:"address"`
+	SecretFile string `json:"secretFile"`
+}
+
+func (entry *relayTargetEntry) UnmarshalJSON(data []byte) error {
+	var address string
+	if json.Unmarshal(data, &address) == nil {
+		entry.Address = address
+		return nil
+	}
+	type plainEntry relayTargetEntry
+	return json.Unmarshal(data, (*plainEntry)(entry))
+}
+
+// relayFileSource reads targets from a JSON or YAML file, again only when
+// its modification time or size changes.
+type relayFileSource struct {
+	Path string
+
+	modified time.Time
+	size     int64
+	targets  []*varnishCliPool
+}
+
+func (source *relayFileSource) String() string {
+	return "file " + source.Path
+}
+
+func (source *relayFileSource) discover(secretFile string) ([]*varnishCliPool, error) {
+	info, err := os.Stat(source.Path)
+	if err != nil {
+		return nil, err
+	}
+	if source.targets != nil && info.ModTime().Equal(source.modified) && info.Size() == source.size {
+		return source.targets, nil
+	}
+
+	fileBytes, err := ioutil.ReadFile(source.Path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []relayTargetEntry
+	switch strings.ToLower(filepath.Ext(source.Path)) {
+	case ".yaml", ".yml":
+		entries, err = parseRelayTargetsYaml(string(fileBytes))
+	default:
+		entries, err = parseRelayTargetsJson(fileBytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse relay targets file '%s': %v", source.Path, err)
+	}
+
+	targets := []*varnishCliPool{}
+	for _, entry := range entries {
+		if entry.Address == "" {
+			return nil, fmt.Errorf("Relay targets file '%s' has a target without an address.", source.Path)
+		}
+		target := &varnishCliPool{Address: entry.Address, SecretFile: entry.SecretFile, Source: source.String()}
+		if target.SecretFile == "" {
+			target.SecretFile = secretFile
+		}
+		targets = append(targets, target)
+	}
+	source.modified, source.size, source.targets = info.ModTime(), info.Size(), targets
+	return targets, nil
+}
+
+// parseRelayTargetsJson accepts an array of targets, or an object with the
+// array as "targets".
+func parseRelayTargetsJson(fileBytes []byte) ([]relayTargetEntry, error) {
+	var entries []relayTargetEntry
+	if err := json.Unmarshal(fileBytes, &entries); err == nil {
+		return entries, nil
+	}
+	var document struct {
+		Targets []relayTargetEntry `json:"targets"`
+	}
+	err := json.Unmarshal(fileBytes, &document)
+	return document.Targets, err
+}
+
+// parseRelayTargetsYaml accepts the subset of YAML needed for a list of
+// targets, optionally under a "targets" key, each either an address or a
+// mapping of address and secretFile:
+//
+//	targets:
+//	  - 10.0.0.1:6082
+//	  - address: 10.0.0.2:6082
+//	    secretFile: /etc/varnish/secret
+func parseRelayTargetsYaml(text string) ([]relayTargetEntry, error) {
+	entries := []relayTargetEntry{}
+	var current *relayTargetEntry
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if index := strings.Index(line, " #"); index >= 0 {
+			line = line[:index]
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if trimmed == "targets:" && line == trimmed {
+			continue
+		}
+
+		if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+			entries = append(entries, relayTargetEntry{})
+			current = &entries[len(entries)-1]
+			trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, "-"))
+			if trimmed == "" {
+				continue
+			}
+			if !strings.Contains(trimmed, ": ") && !strings.HasSuffix(trimmed, ":") {
+				current.Address = unquoteYamlScalar(trimmed)
+				current = nil
+				continue
+			}
+		}
+		if current == nil {
+			return nil, fmt.Errorf("line %d: expected a list item", lineNumber)
+		}
+
+		parts := strings.SplitN(trimmed, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected 'key: value'", lineNumber)
+		}
+		value := unquoteYamlScalar(strings.TrimSpace(parts[1]))
+		switch strings.TrimSpace(parts[0]) {
+		case "address":
+			current.Address = value
+		case "secretFile":
+			current.SecretFile = value
+		default:
+			return nil, fmt.Errorf("line %d: unknown key '%s'", lineNumber, strings.TrimSpace(parts[0]))
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func unquoteYamlScalar(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		if value[0] == '"' {
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				return unquoted
+			}
+		}
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// relayDnsSource resolves targets from DNS: SRV records for a name starting
+// with an underscore, such as _varnish-admin._tcp.example.com, otherwise the
+// A and AAAA records of host:port.
+type relayDnsSource struct {
+	Name string
+}
+
+func (source *relayDnsSource) String() string {
+	return "dns " + source.Name
+}
+
+func (source *relayDnsSource) discover(secretFile string) ([]*varnishCliPool, error) {
+	addresses := []string{}
+	if strings.HasPrefix(source.Name, "_") {
+		_, records, err := net.LookupSRV("", "", source.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+		}
+	} else {
+		host, port, err := net.SplitHostPort(source.Name)
+		if err != nil {
+			return nil, fmt.Errorf("DNS relay targets '%s' must be host:port or an SRV name: %v", source.Name, err)
+		}
+		ips, err := net.LookupHost(host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			addresses = append(addresses, net.JoinHostPort(ip, port))
+		}
+	}
+
+	targets := []*varnishCliPool{}
+	for _, address := range addresses {
+		targets = append(targets, &varnishCliPool{Address: address, SecretFile: secretFile, Source: source.String()})
+	}
+	return targets, nil
+}
+
+// relayDiscovery refreshes the discovered targets of a relay backend on an
+// interval. A source which fails keeps its last targets.
+type relayDiscovery struct {
+	Sources    []relayTargetSource
+	SecretFile string
+	Interval   time.Duration
+
+	discovered map[relayTargetSource][]*varnishCliPool
+}
+
+// refresh queries every source, returning the targets found by all of them
+// and the first error.
+func (discovery *relayDiscovery) refresh() ([]*varnishCliPool, error) {
+	if discovery.discovered == nil {
+		discovery.discovered = map[relayTargetSource][]*varnishCliPool{}
+	}
+	var firstErr error
+	targets := []*varnishCliPool{}
+	for _, source := range discovery.Sources {
+		found, err := source.discover(discovery.SecretFile)
+		if err != nil {
+			log.Printf("Relay target discovery from %s failed: %v", source, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			found = discovery.discovered[source]
+		} else {
+			discovery.discovered[source] = found
+		}
+		targets = append(targets, found...)
+	}
+	return targets, firstErr
+}
+
+// watch refreshes the targets of the backend until the process exits.
+func (discovery *relayDiscovery) watch(backend *relayBackend) {
+	ticker := time.NewTicker(discovery.Interval)
+	for range ticker.C {
+		targets, _ := discovery.refresh()
+		backend.setDiscoveredTargets(targets)
+	}
+}
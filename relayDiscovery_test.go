@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRelayTargetsYaml(t *testing.T) {
+	entries, err := parseRelayTargetsYaml(`---
+# the edge fleet
+targets:
+  - 10.0.0.1:6082
+  - address: "10.0.0.2:6082" # canary
+    secretFile: /etc/varnish/canary-secret
+  -
+    address: 10.0.0.3:6082
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []relayTargetEntry{
+		{Address: "10.0.0.1:6082"},
+		{Address: "10.0.0.2:6082", SecretFile: "/etc/varnish/canary-secret"},
+		{Address: "10.0.0.3:6082"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %#v but was %#v.", expected, entries)
+	}
+	for index := range expected {
+		if entries[index] != expected[index] {
+			t.Errorf("Expected %#v but was %#v.", expected[index], entries[index])
+		}
+	}
+
+	_, err = parseRelayTargetsYaml("targets:\n  - address: 10.0.0.1:6082\n    port: 6082\n")
+	if err == nil {
+		t.Errorf("Expected an unknown key to be refused.")
+	}
+}
+
+func TestParseRelayTargetsJson(t *testing.T) {
+	for _, document := range []string{
+		`["10.0.0.1:6082", {"address": "10.0.0.2:6082", "secretFile": "/etc/varnish/secret"}]`,
+		`{"targets": ["10.0.0.1:6082", {"address": "10.0.0.2:6082", "secretFile": "/etc/varnish/secret"}]}`,
+	} {
+		entries, err := parseRelayTargetsJson([]byte(document))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0].Address != "10.0.0.1:6082" || entries[1].SecretFile != "/etc/varnish/secret" {
+			t.Errorf("Unexpected entries %#v from %s.", entries, document)
+		}
+	}
+}
+
+func TestRelayTargetsFollowTargetsFile(t *testing.T) {
+	defer func(previous time.Duration) { relayDiscoveryInterval = previous }(relayDiscoveryInterval)
+	relayDiscoveryInterval = time.Hour
+	directory, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	file := filepath.Join(directory, "targets.yaml")
+	ioutil.WriteFile(file, []byte("- 10.0.0.1:6082\n- 10.0.0.2:6082\n"), 0644)
+
+	backend, err := newRelayBackend(&varnishCliListener{
+		RelayTargets:     "10.0.0.9:6082",
+		RelayTargetsFile: file,
+		RelaySecretFile:  "/etc/varnish/secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, _ := backend.currentTargets()
+	if len(targets) != 3 || targets[0].Source != "static" || targets[2].Address != "10.0.0.2:6082" || targets[2].SecretFile != "/etc/varnish/secret" {
+		t.Fatalf("Unexpected targets %#v.", targets)
+	}
+	kept := targets[2]
+
+	// what the watcher does on its next tick
+	source := &relayFileSource{Path: file}
+	ioutil.WriteFile(file, []byte("- 10.0.0.2:6082\n- 10.0.0.3:6082\n"), 0644)
+	discovered, err := source.discover("/etc/varnish/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.setDiscoveredTargets(discovered)
+
+	targets, _ = backend.currentTargets()
+	if len(targets) != 3 || targets[1] != kept || targets[2].Address != "10.0.0.3:6082" {
+		t.Errorf("Expected the remaining target to be kept and the new one added but was %#v.", targets)
+	}
+
+	mockWriter := new(bytes.Buffer)
+	listener := newTestListener("4.0")
+	listener.backend = backend
+	handleVarnishCliRelayTargets(&varnishCliSession{Writer: mockWriter, Listener: listener})
+	actual := mockWriter.String()
+	if !strings.Contains(actual, "10.0.0.9:6082") || !strings.Contains(actual, "static") || !strings.Contains(actual, "file "+file) || strings.Contains(actual, "10.0.0.1:6082") {
+		t.Errorf("Expected relay.targets to list the current targets but was %#v.", actual)
+	}
+}
+
+func TestRelayTargetsFromDnsARecords(t *testing.T) {
+	targets, err := (&relayDnsSource{Name: "localhost:6082"}).discover("")
+	if err != nil {
+		t.Skipf("localhost does not resolve: %v", err)
+	}
+	if len(targets) == 0 || !strings.HasSuffix(targets[0].Address, ":6082") || targets[0].Source != "dns localhost:6082" {
+		t.Errorf("Unexpected targets %#v.", targets)
+	}
+}
+
+func TestRelayTargetsRequiresRelayBackend(t *testing.T) {
+	mockWriter := new(bytes.Buffer)
+	handleVarnishCliRelayTargets(&varnishCliSession{Writer: mockWriter, Listener: newTestListener("4.0", "https://aperture.section.io/api/v1")})
+	if actual := mockWriter.String(); !strings.HasPrefix(actual, "300 ") {
+		t.Errorf("Expected relay.targets to be refused but was %#v.", actual)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// listenAddressNone disables listening, as for varnishd -T none, so that a
+// listener only serves the management consoles it connects to.
+const listenAddressNone = "none"
+
+var (
+	reverseConnectMinimumBackoff = time.Second
+	reverseConnectMaximumBackoff = time.Minute
+)
+
+// parseManagementAddresses parses a comma-separated list of management
+// console addresses.
+func parseManagementAddresses(addresses string) []string {
+	parsed := []string{}
+	for _, address := range strings.Split(addresses, ",") {
+		address = strings.TrimSpace(address)
+		if address != "" {
+			parsed = append(parsed, address)
+		}
+	}
+	return parsed
+}
+
+// serveManagementConsole connects to a management console as varnishd -M
+// does and serves the CLI over the connection, as if the console had
+// connected to the listener. It connects again when the connection cannot be
+// made or drops, waiting twice as long after each failure up to the maximum
+// backoff. It never returns.
+func serveManagementConsole(address string, listener *varnishCliListener) {
+	backoff := reverseConnectMinimumBackoff
+	for {
+		connection, err := net.DialTimeout("tcp", address, varnishCliTimeout)
+		if err != nil {
+			log.Printf("Listener '%s' failed to connect to management console '%s', retrying in %v: %v", listener.Name, address, backoff, err)
+		} else {
+			log.Printf("Listener '%s' connected to management console '%s'.", listener.Name, address)
+			connected := time.Now()
+			handleConnection(connection, listener)
+			// a connection which lasted is not a failure to back off from
+			if time.Since(connected) > reverseConnectMaximumBackoff {
+				backoff = reverseConnectMinimumBackoff
+			}
+			log.Printf("Listener '%s' disconnected from management console '%s', reconnecting in %v.", listener.Name, address, backoff)
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > reverseConnectMaximumBackoff {
+			backoff = reverseConnectMaximumBackoff
+		}
+	}
+}
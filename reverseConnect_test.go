@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func acceptManagementConnection(t *testing.T, console net.Listener) (net.Conn, *varnishCliClient) {
+	console.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	connection, err := console.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	connection.SetDeadline(time.Now().Add(5 * time.Second))
+	return connection, &varnishCliClient{connection: connection, reader: bufio.NewReader(connection)}
+}
+
+func TestManagementConsoleIsServedAndReconnected(t *testing.T) {
+	defer func(minimum, maximum time.Duration) {
+		reverseConnectMinimumBackoff, reverseConnectMaximumBackoff = minimum, maximum
+	}(reverseConnectMinimumBackoff, reverseConnectMaximumBackoff)
+	reverseConnectMinimumBackoff, reverseConnectMaximumBackoff = time.Millisecond, 10*time.Millisecond
+
+	console, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer console.Close()
+	listener := newTestListener("4.1")
+	go serveManagementConsole(console.Addr().String(), listener)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		connection, client := acceptManagementConnection(t, console)
+		status, body, err := client.readResponse()
+		if err != nil || status != CLIS_OK || !strings.Contains(body, "Varnish Cache CLI Bridge") {
+			t.Fatalf("Expected the banner on connection %d but was %d %#v, %v.", attempt, status, body, err)
+		}
+		status, body, err = client.call("ping")
+		if err != nil || status != CLIS_OK || !strings.HasPrefix(body, "PONG") {
+			t.Errorf("Expected a ping response on connection %d but was %d %#v, %v.", attempt, status, body, err)
+		}
+		// the bridge connects again when the console drops the connection
+		connection.Close()
+	}
+}
+
+func TestManagementConsoleIsChallenged(t *testing.T) {
+	console, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer console.Close()
+	listener := newTestListener("4.1")
+	listener.SecretFile = "/nonexistent/secret"
+	go serveManagementConsole(console.Addr().String(), listener)
+
+	connection, client := acceptManagementConnection(t, console)
+	defer connection.Close()
+	status, body, err := client.readResponse()
+	if err != nil || status != CLIS_AUTH || len(body) != 32 {
+		t.Errorf("Expected an authentication challenge but was %d %#v, %v.", status, body, err)
+	}
+	io.WriteString(connection, "vcl.list\n")
+	status, _, err = client.readResponse()
+	if err != nil || status != CLIS_AUTH {
+		t.Errorf("Expected commands to require authentication but was %d, %v.", status, err)
+	}
+}
+
+func TestListenAddressNoneRequiresManagementAddress(t *testing.T) {
+	listener := newTestListener("4.1")
+	listener.ListenAddress = listenAddressNone
+	if err := listener.prepare(); err == nil {
+		t.Errorf("Expected a listener with neither a listen nor a management address to be refused.")
+	}
+}
+
+func TestConsoleClosingBeforeResponseEndsOnlyTheSession(t *testing.T) {
+	console, bridge := net.Pipe()
+	go func() {
+		client := &varnishCliClient{connection: console, reader: bufio.NewReader(console)}
+		client.readResponse()
+		io.WriteString(console, "ping\n")
+		// the console goes away without reading the response to ping
+		console.Close()
+	}()
+
+	done := make(chan bool)
+	go func() {
+		handleConnection(bridge, newTestListener("4.1"))
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the session to end when the response cannot be sent.")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+type jsonBanRequest struct {
+	Proxy string `json:"proxy"`
+	Ban   string `json:"ban"`
+}
+
+type jsonUpdateVclRequest struct {
+	Personality string `json:"personality"`
+	Message     string `json:"message"`
+	Content     string `json:"content"`
+}
+
+// sectionioBackend sends bans and VCL to the proxies of one or more section.io
+// applications via the section.io API.
+type sectionioBackend struct {
+	targets []sectionioTarget
+}
+
+func newSectionioBackend(apiEndpoint string) (*sectionioBackend, error) {
+	if sectionioUsername == "" {
+		return nil, fmt.Errorf("section.io username is required.")
+	}
+	if sectionioPassword == "" {
+		return nil, fmt.Errorf("SECTION_IO_PASSWORD environment variable is required.")
+	}
+	targets, err := parseApiEndpoints(apiEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("section.io API endpoint is required.")
+	}
+	for _, target := range targets {
+		log.Printf("Using API endpoint '%s'.", target.endpoint())
+	}
+	return &sectionioBackend{targets: targets}, nil
+}
+
+func (backend *sectionioBackend) Name() string {
+	return sectionioBackendName
+}
+
+// targetList returns the targets for the helpers shared between backends.
+func (backend *sectionioBackend) targetList() []fmt.Stringer {
+	targets := make([]fmt.Stringer, len(backend.targets))
+	for index, target := range backend.targets {
+		targets[index] = target
+	}
+	return targets
+}
+
+func (backend *sectionioBackend) ApplyBan(expression string, dryRun bool) backendResult {
+	results := callBackendTargets(backend.targetList(), func(target fmt.Stringer) backendTargetResult {
+		return backendTargetResult{Err: postBan(target.(sectionioTarget), expression, dryRun)}
+	})
+	return backendResult{
+		OK:      backendTargetsSucceeded(results),
+		Summary: formatBackendTargetResults(results),
+	}
+}
+
+// postBan forwards a ban expression to the proxy of one target.
+func postBan(target sectionioTarget, args string, dryRun bool) error {
+
+	requestURL, err := url.Parse(target.endpoint() + "state")
+	if err != nil {
+		log.Printf("Error parsing url: %v", err)
+		return fmt.Errorf("Failed to parse API URL.")
+	}
+	q := requestURL.Query()
+	q.Set("banExpression", args)
+	requestURL.RawQuery = q.Encode()
+
+	request, err := http.NewRequest("POST", requestURL.String(), nil)
+
+	if err != nil {
+		log.Printf("Error composing ban request: %v", err)
+		return fmt.Errorf("Failed to compose the API request.")
+	}
+
+	request.Header.Set("User-Agent", userAgent)
+	request.Header.Set("Content-Type", "application/json")
+	request.SetBasicAuth(sectionioUsername, sectionioPassword)
+
+	response, err := sendApiRequest(request, dryRun)
+	if err != nil {
+		log.Printf("Error posting ban request '%s': %v", args, err)
+		return fmt.Errorf("Failed to forward the ban.")
+	}
+	defer response.Body.Close()
+	responseBodyBytes, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		log.Printf("Error reading ban API response: %v", err)
+		return fmt.Errorf("Failed to parse the API response.")
+	}
+
+	log.Printf("responseBodyText: %s", string(responseBodyBytes))
+
+	if response.StatusCode == 200 || response.StatusCode == 204 {
+		// TODO parse response body as JSON, expect:
+		// {"success":true,"description":"Ban applied"}
+		return nil
+	}
+
+	log.Printf("Unexpected API response status: %d, body: %s",
+		response.StatusCode,
+		string(responseBodyBytes))
+
+	return fmt.Errorf("API responded with status %d.", response.StatusCode)
+}
+
+func (backend *sectionioBackend) DeployVcl(request vclDeployRequest, dryRun bool) backendResult {
+	result := deployVclToBackendTargets(backend.targetList(), request, func(target fmt.Stringer, request vclDeployRequest) backendTargetResult {
+		postValues := jsonUpdateVclRequest{
+			Personality: request.Personality,
+			Message:     request.Message,
+			Content:     request.Content,
+		}
+		response, err := jsonPost(target.(sectionioTarget).endpoint()+"configuration", "configuration update", postValues, dryRun)
+		return backendTargetResult{Response: response, Err: err}
+	})
+	if result.OK {
+		log.Printf("Update submitted. Response message: %s", result.Response["message"])
+	}
+	return result
+}
+
+func (backend *sectionioBackend) DeployedVcl() (string, error) {
+	// the first target is the primary, whose VCL the others are expected to match
+	response, err := jsonGet(backend.targets[0].endpoint()+"configuration", "configuration retrieval")
+	if err != nil {
+		return "", err
+	}
+
+	content, ok := response["content"].(string)
+	if !ok {
+		log.Printf("Configuration API response has no content: %v", response)
+		return "", fmt.Errorf("The configuration retrieval API response has no content.")
+	}
+	return content, nil
+}
+
+func (backend *sectionioBackend) ListBans() (string, error) {
+	return "", errBackendUnsupported
+}
+
+// Status checks that the configuration of every target can be retrieved.
+func (backend *sectionioBackend) Status() (string, error) {
+	results := callBackendTargets(backend.targetList(), func(target fmt.Stringer) backendTargetResult {
+		_, err := jsonGet(target.(sectionioTarget).endpoint()+"configuration", "configuration retrieval")
+		return backendTargetResult{Err: err}
+	})
+	return backendTargetStatus(results)
+}
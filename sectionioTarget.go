@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sectionioTarget is one section.io application environment proxy to which
+// bans and VCL deployments are sent.
+type sectionioTarget struct {
+	UrlPrefix   string
+	Account     string
+	Application string
+	Environment string
+	ProxyName   string
+}
+
+const (
+	apiFailurePolicyAllOrNothing = "all-or-nothing"
+	apiFailurePolicyBestEffort   = "best-effort"
+)
+
+var apiFailurePolicy = apiFailurePolicyAllOrNothing
+
+// endpoint is the API URL of the proxy, with a trailing slash.
+func (target sectionioTarget) endpoint() string {
+	return fmt.Sprintf("%s/account/%s/application/%s/environment/%s/proxy/%s/",
+		target.UrlPrefix, target.Account, target.Application, target.Environment, target.ProxyName)
+}
+
+func (target sectionioTarget) String() string {
+	return fmt.Sprintf("account/%s/application/%s/environment/%s/proxy/%s",
+		target.Account, target.Application, target.Environment, target.ProxyName)
+}
+
+// parseApiEndpoint parses a section.io application URL, filling in the
+// default environment and proxy name when the URL does not include them.
+func parseApiEndpoint(endpoint string) (sectionioTarget, error) {
+	match := sectionioApiEndpointRx.FindStringSubmatch(endpoint)
+	if match == nil {
+		return sectionioTarget{}, fmt.Errorf("API endpoint '%s' is invalid.", endpoint)
+	}
+	names := sectionioApiEndpointRx.SubexpNames()
+	nameMap := map[string]string{}
+	for i, n := range match {
+		nameMap[names[i]] = n
+	}
+
+	target := sectionioTarget{
+		UrlPrefix:   nameMap["prefix"],
+		Account:     nameMap["account"],
+		Application: nameMap["application"],
+		Environment: sectionioEnvironment,
+		ProxyName:   sectionioProxyName,
+	}
+	if nameMap["environment"] != "" {
+		target.Environment = nameMap["environment"]
+	}
+	if nameMap["proxy"] != "" {
+		target.ProxyName = nameMap["proxy"]
+	}
+	return target, nil
+}
+
+// parseApiEndpoints parses a comma-separated list of section.io application
+// URLs.
+func parseApiEndpoints(endpoints string) ([]sectionioTarget, error) {
+	targets := []sectionioTarget{}
+	for _, endpoint := range strings.Split(endpoints, ",") {
+		endpoint = strings.TrimSpace(endpoint)
+		if endpoint == "" {
+			continue
+		}
+		target, err := parseApiEndpoint(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
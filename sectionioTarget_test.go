@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestSectionioTargets(urls ...string) []sectionioTarget {
+	targets := []sectionioTarget{}
+	for index, url := range urls {
+		targets = append(targets, sectionioTarget{
+			UrlPrefix:   url,
+			Account:     "1",
+			Application: strconv.Itoa(index + 1),
+			Environment: "Production",
+			ProxyName:   "varnish",
+		})
+	}
+	return targets
+}
+
+func TestParseApiEndpoints(t *testing.T) {
+	targets, err := parseApiEndpoints("https://aperture.section.io/api/v1/account/1/application/2/environment/Staging/proxy/edge, https://aperture.section.io/api/v1/account/1/application/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"https://aperture.section.io/api/v1/account/1/application/2/environment/Staging/proxy/edge/",
+		"https://aperture.section.io/api/v1/account/1/application/3/environment/Production/proxy/varnish/",
+	}
+	if len(targets) != len(expected) {
+		t.Fatalf("Expected %d targets but was %#v.", len(expected), targets)
+	}
+	for index, target := range targets {
+		if actual := target.endpoint(); actual != expected[index] {
+			t.Errorf("Expected %#v but was %#v.", expected[index], actual)
+		}
+	}
+
+	_, err = parseApiEndpoints("https://aperture.section.io/api/v1/application/3")
+	if err == nil {
+		t.Errorf("Expected an endpoint without an account to be invalid.")
+	}
+}
+
+func TestVclUseFansOutToTargets(t *testing.T) {
+	defer func(previousPolicy string) { apiFailurePolicy = previousPolicy }(apiFailurePolicy)
+	parseVclMessageTemplate("Update")
+
+	var mutex sync.Mutex
+	posted := map[string][]string{}
+	handler := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			if request.Method == "GET" {
+				response.Write([]byte(`{"content":""}`))
+				return
+			}
+			var body jsonUpdateVclRequest
+			json.NewDecoder(request.Body).Decode(&body)
+			mutex.Lock()
+			posted[name] = append(posted[name], body.Content)
+			mutex.Unlock()
+			response.WriteHeader(status)
+			response.Write([]byte(`{"message":"ok"}`))
+		}))
+	}
+	good := handler("good", 200)
+	defer good.Close()
+	bad := handler("bad", 500)
+	defer bad.Close()
+	listener := newTestListener("4.0", good.URL, bad.URL)
+
+	listener.configs.add(vclConfig{Name: "first", Source: "vcl 4.0;", Personality: "Varnish4"})
+	listener.configs.add(vclConfig{Name: "second", Source: "vcl 4.0;\nsub vcl_recv {}", Personality: "Varnish4"})
+	listener.history.record(vclDeployment{ConfigName: "first", Personality: "Varnish4", Content: "vcl 4.0;"})
+
+	mockWriter := new(bytes.Buffer)
+	session := &varnishCliSession{Writer: mockWriter, Identity: "secret", Listener: listener}
+
+	apiFailurePolicy = apiFailurePolicyAllOrNothing
+	handleVarnishCliVclUse("second", session)
+	actual := mockWriter.String()
+	if !strings.HasPrefix(actual, "300 ") || !strings.Contains(actual, "account/1/application/2/environment/Production/proxy/varnish: Call for configuration update failed with status 500.") {
+		t.Errorf("Expected all-or-nothing to fail naming the failed target but was %#v.", actual)
+	}
+	if !strings.Contains(actual, "Reverted to revision 1:\naccount/1/application/1/environment/Production/proxy/varnish: OK") {
+		t.Errorf("Expected the good target to be reverted but was %#v.", actual)
+	}
+	if contents := posted["good"]; len(contents) != 2 || contents[1] != "vcl 4.0;" {
+		t.Errorf("Expected the good target to receive the previous revision again but was %#v.", contents)
+	}
+	if listener.configs.active() == "second" || len(listener.history.list()) != 1 {
+		t.Errorf("Expected the failed deployment not to be recorded.")
+	}
+
+	mockWriter.Reset()
+	apiFailurePolicy = apiFailurePolicyBestEffort
+	handleVarnishCliVclUse("second", session)
+	actual = mockWriter.String()
+	if !strings.HasPrefix(actual, "200 ") || !strings.Contains(actual, "proxy/varnish: OK\n") {
+		t.Errorf("Expected best-effort to succeed with per-target results but was %#v.", actual)
+	}
+	deployments := listener.history.list()
+	if len(deployments) != 2 || len(deployments[1].Failures) != 1 {
+		t.Errorf("Expected the partial failure to be recorded but was %#v.", deployments)
+	}
+}
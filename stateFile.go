@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomically replaces the file at path with data such that readers
+// only ever observe the old or the new content, never a partial write.
+func writeFileAtomically(path string, data []byte) error {
+	directory, name := filepath.Split(path)
+	if directory == "" {
+		directory = "."
+	}
+
+	file, err := ioutil.TempFile(directory, "."+name+".")
+	if err != nil {
+		return err
+	}
+	tempPath := file.Name()
+	defer os.Remove(tempPath) // no-op after a successful rename
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		return err
+	}
+
+	// sync the directory so the rename itself survives a crash
+	directoryFile, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer directoryFile.Close()
+	return directoryFile.Sync()
+}
+
+// checkStateDirectory makes sure state files can be written to the directory
+// by creating and removing a file in it.
+func checkStateDirectory(directory string) error {
+	file, err := ioutil.TempFile(directory, ".probe.")
+	if err != nil {
+		return fmt.Errorf("State directory '%s' is not writable: %v", directory, err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const varnishCliTimeout = time.Minute
+
+// maximumIdleVarnishCliClients is how many authenticated connections a pool
+// keeps open to one varnishd between commands.
+const maximumIdleVarnishCliClients = 4
+
+// maximumVarnishCliResponseLength bounds the body of a response read from
+// varnishd, well above the default cli_limit of 48k.
+const maximumVarnishCliResponseLength = 8 << 20
+
+// varnishCliClient is an authenticated connection to the CLI of a varnishd,
+// as opened by varnishadm with -T and -S.
+type varnishCliClient struct {
+	connection net.Conn
+	reader     *bufio.Reader
+}
+
+// varnishCliError is a response from varnishd with a status other than
+// CLIS_OK.
+type varnishCliError struct {
+	Status VarnishCliResponseStatus
+	Body   string
+}
+
+func (err *varnishCliError) Error() string {
+	return fmt.Sprintf("%d %s", err.Status, strings.TrimSpace(err.Body))
+}
+
+// varnishCliWriteError is a failure to send a command, after which varnishd
+// cannot have run it.
+type varnishCliWriteError struct {
+	Err error
+}
+
+func (err *varnishCliWriteError) Error() string {
+	return err.Err.Error()
+}
+
+// dialVarnishCli connects to a varnishd admin port and answers its
+// authentication challenge with the secret file, if it sends one.
+func dialVarnishCli(address string, secretFile string) (*varnishCliClient, error) {
+	connection, err := net.DialTimeout("tcp", address, varnishCliTimeout)
+	if err != nil {
+		return nil, err
+	}
+	client := &varnishCliClient{
+		connection: connection,
+		reader:     bufio.NewReader(connection),
+	}
+
+	connection.SetDeadline(time.Now().Add(varnishCliTimeout))
+	status, body, err := client.readResponse()
+	if err == nil && status == CLIS_AUTH {
+		status, body, err = client.authenticate(body, secretFile)
+	}
+	if err == nil && status != CLIS_OK {
+		err = &varnishCliError{Status: status, Body: body}
+	}
+	if err != nil {
+		client.close()
+		return nil, err
+	}
+	log.Printf("Connected to the varnishd CLI at '%s'.", address)
+	return client, nil
+}
+
+// authenticate answers a challenge of which the first line is the challenge
+// itself, with the same authenticator the bridge expects from its clients.
+func (client *varnishCliClient) authenticate(challengeBody string, secretFile string) (VarnishCliResponseStatus, string, error) {
+	if secretFile == "" {
+		return 0, "", fmt.Errorf("Authentication required but no secret file is configured.")
+	}
+	secretBytes, err := getVarnishSecret(secretFile)
+	if err != nil {
+		return 0, "", err
+	}
+	challenge := strings.SplitN(challengeBody, "\n", 2)[0]
+	return client.call("auth " + computeVarnishAuthenticator(challenge, secretBytes))
+}
+
+// call sends a command line and reads the response to it.
+func (client *varnishCliClient) call(command string) (VarnishCliResponseStatus, string, error) {
+	client.connection.SetDeadline(time.Now().Add(varnishCliTimeout))
+	_, err := io.WriteString(client.connection, command+"\n")
+	if err != nil {
+		return 0, "", &varnishCliWriteError{Err: err}
+	}
+	return client.readResponse()
+}
+
+// isClosed checks whether an idle connection was closed by varnishd, without
+// waiting longer than a moment for data which should not be there.
+func (client *varnishCliClient) isClosed() bool {
+	client.connection.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := client.reader.Peek(1)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return false
+	}
+	// closed, reset, or sending something no command asked for
+	return true
+}
+
+// readResponse reads a status line of the status code and body length, the
+// body and the newline which follows it.
+func (client *varnishCliClient) readResponse() (VarnishCliResponseStatus, string, error) {
+	statusLine, err := client.reader.ReadString('\n')
+	if err != nil {
+		return 0, "", err
+	}
+	var status, length int
+	_, err = fmt.Sscanf(statusLine, "%d %d", &status, &length)
+	if err != nil {
+		return 0, "", fmt.Errorf("Invalid CLI status line %#v.", statusLine)
+	}
+	if length < 0 || length > maximumVarnishCliResponseLength {
+		return 0, "", fmt.Errorf("Invalid CLI response length %d.", length)
+	}
+	body := make([]byte, length+1)
+	_, err = io.ReadFull(client.reader, body)
+	if err != nil {
+		return 0, "", err
+	}
+	return VarnishCliResponseStatus(status), string(body[:length]), nil
+}
+
+func (client *varnishCliClient) close() {
+	client.connection.Close()
+}
+
+// varnishCliPool keeps authenticated connections to one varnishd, opening
+// new ones as needed.
+type varnishCliPool struct {
+	Address    string
+	SecretFile string
+	// Source describes where the address was configured or discovered.
+	Source string
+
+	mutex  sync.Mutex
+	idle   []*varnishCliClient
+	closed bool
+}
+
+func (pool *varnishCliPool) String() string {
+	return pool.Address
+}
+
+// key identifies pools which connect to the same varnishd in the same way.
+func (pool *varnishCliPool) key() string {
+	return pool.Address + "=" + pool.SecretFile
+}
+
+// idleCount is the number of connections open between commands.
+func (pool *varnishCliPool) idleCount() int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return len(pool.idle)
+}
+
+// call sends a command on a pooled connection and returns the response. A
+// pooled connection which varnishd closed while idle, or on which the command
+// cannot be sent, is replaced by a newly authenticated one. Once the command
+// is sent it is never sent again, since it may have run already.
+func (pool *varnishCliPool) call(command string) (VarnishCliResponseStatus, string, error) {
+	client, reused, err := pool.get()
+	if err != nil {
+		return 0, "", err
+	}
+	if reused && client.isClosed() {
+		log.Printf("Pooled connection to '%s' was closed, reconnecting.", pool.Address)
+		client.close()
+		client, err = dialVarnishCli(pool.Address, pool.SecretFile)
+		if err != nil {
+			return 0, "", err
+		}
+		reused = false
+	}
+	status, body, err := client.call(command)
+	if _, ok := err.(*varnishCliWriteError); ok && reused {
+		log.Printf("Pooled connection to '%s' failed, reconnecting: %v", pool.Address, err)
+		client.close()
+		client, err = dialVarnishCli(pool.Address, pool.SecretFile)
+		if err != nil {
+			return 0, "", err
+		}
+		status, body, err = client.call(command)
+	}
+	if err != nil {
+		client.close()
+		return 0, "", err
+	}
+	pool.put(client)
+	return status, body, nil
+}
+
+// command calls a command, returning the body of the response or a
+// varnishCliError when the status is not CLIS_OK.
+func (pool *varnishCliPool) command(command string) (string, error) {
+	status, body, err := pool.call(command)
+	if err != nil {
+		return "", err
+	}
+	if status != CLIS_OK {
+		return "", &varnishCliError{Status: status, Body: body}
+	}
+	return body, nil
+}
+
+func (pool *varnishCliPool) get() (*varnishCliClient, bool, error) {
+	pool.mutex.Lock()
+	if count := len(pool.idle); count > 0 {
+		client := pool.idle[count-1]
+		pool.idle = pool.idle[:count-1]
+		pool.mutex.Unlock()
+		return client, true, nil
+	}
+	pool.mutex.Unlock()
+
+	client, err := dialVarnishCli(pool.Address, pool.SecretFile)
+	return client, false, err
+}
+
+func (pool *varnishCliPool) put(client *varnishCliClient) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.closed || len(pool.idle) >= maximumIdleVarnishCliClients {
+		client.close()
+		return
+	}
+	pool.idle = append(pool.idle, client)
+}
+
+// close closes the idle connections of the pool, and those of commands in
+// progress when they complete.
+func (pool *varnishCliPool) close() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.closed = true
+	for _, client := range pool.idle {
+		client.close()
+	}
+	pool.idle = nil
+}
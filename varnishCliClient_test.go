@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startFakeVarnishd answers like varnishd: an authentication challenge with
+// the explanation varnishd adds to it, then the response from respond to
+// every command.
+func startFakeVarnishd(t *testing.T, secret string, respond func(command string) (VarnishCliResponseStatus, string)) string {
+	netListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			connection, err := netListener.Accept()
+			if err != nil {
+				return
+			}
+			go func(connection net.Conn) {
+				defer connection.Close()
+				const challenge = "abcdefghijklmnopqrstuvwxyzabcdef"
+				writeVarnishCliResponse(connection, CLIS_AUTH, challenge+"\n\nAuthentication required.\n")
+				scanner := bufio.NewScanner(connection)
+				if !scanner.Scan() || scanner.Text() != "auth "+computeVarnishAuthenticator(challenge, []byte(secret)) {
+					writeVarnishCliResponse(connection, CLIS_CLOSE, "Closing CLI connection")
+					return
+				}
+				writeVarnishCliResponse(connection, CLIS_OK, "-----------------------------\nVarnish Cache CLI 1.0\n")
+				for scanner.Scan() {
+					status, body := respond(scanner.Text())
+					writeVarnishCliResponse(connection, status, body)
+				}
+			}(connection)
+		}
+	}()
+	return netListener.Addr().String()
+}
+
+func TestUnimplementedCommandsPassThroughToUpstream(t *testing.T) {
+	directory, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	secretFile := filepath.Join(directory, "secret")
+	ioutil.WriteFile(secretFile, []byte("upstream secret\n"), 0600)
+
+	received := []string{}
+	address := startFakeVarnishd(t, "upstream secret\n", func(command string) (VarnishCliResponseStatus, string) {
+		received = append(received, command)
+		if strings.HasPrefix(command, "backend.set_health") {
+			return CLIS_PARAM, "Invalid state bogus"
+		}
+		return CLIS_OK, "Storage devices:\n\tstorage.Transient = malloc\n"
+	})
+
+	backend := &fakeBackend{}
+	listener := newTestListener("4.1")
+	listener.backend = backend
+	listener.upstream = &varnishCliPool{Address: address, SecretFile: secretFile}
+	mockWriter := new(bytes.Buffer)
+	session := &varnishCliSession{Writer: mockWriter, HasAuthenticated: true, Listener: listener}
+
+	handleRequest("storage.list", session)
+	expected := "200 45      \nStorage devices:\n\tstorage.Transient = malloc\n\n"
+	if actual := mockWriter.String(); actual != expected {
+		t.Errorf("Expected %#v but was %#v.", expected, actual)
+	}
+
+	mockWriter.Reset()
+	handleRequest("backend.set_health default bogus", session)
+	expected = "106 19      \nInvalid state bogus\n"
+	if actual := mockWriter.String(); actual != expected {
+		t.Errorf("Expected %#v but was %#v.", expected, actual)
+	}
+
+	// commands the bridge implements are not passed through
+	mockWriter.Reset()
+	handleRequest(`ban req.url ~ /`, session)
+	if len(backend.bans) != 1 || len(received) != 2 || received[1] != "backend.set_health default bogus" {
+		t.Errorf("Expected only unimplemented commands upstream but received %#v.", received)
+	}
+}
+
+func TestPassthroughReportsUnreachableUpstream(t *testing.T) {
+	netListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := netListener.Addr().String()
+	netListener.Close()
+
+	listener := newTestListener("4.1")
+	listener.upstream = &varnishCliPool{Address: address}
+	mockWriter := new(bytes.Buffer)
+	handleRequest("panic.show", &varnishCliSession{Writer: mockWriter, HasAuthenticated: true, Listener: listener})
+	if actual := mockWriter.String(); !strings.HasPrefix(actual, "400 ") {
+		t.Errorf("Expected a communication error but was %#v.", actual)
+	}
+}
+
+func TestVarnishCliClientRejectsInvalidResponseLength(t *testing.T) {
+	for _, statusLine := range []string{"200 -1\n", "200 99999999\n"} {
+		client := &varnishCliClient{reader: bufio.NewReader(strings.NewReader(statusLine))}
+		_, _, err := client.readResponse()
+		if err == nil || !strings.HasPrefix(err.Error(), "Invalid CLI response length") {
+			t.Errorf("Expected the length of %#v to be refused but was %v.", statusLine, err)
+		}
+	}
+}
+
+func TestDryRunPassesReadOnlyCommandsThrough(t *testing.T) {
+	directory, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	secretFile := writeTestSecret(t, directory, "secret", "upstream secret\n")
+
+	received := []string{}
+	address := startFakeVarnishd(t, "upstream secret\n", func(command string) (VarnishCliResponseStatus, string) {
+		received = append(received, command)
+		return CLIS_OK, "Present bans:\n1500000000.000000     0 -  req.url ~ /\n"
+	})
+
+	listener := newTestListener("4.1")
+	listener.upstream = &varnishCliPool{Address: address, SecretFile: secretFile}
+	mockWriter := new(bytes.Buffer)
+	session := &varnishCliSession{Writer: mockWriter, HasAuthenticated: true, DryRun: true, Listener: listener}
+
+	handleRequest("storage.list", session)
+	handleRequest("backend.set_health default sick", session)
+	// the sectionio backend cannot list bans, so the upstream answers
+	handleRequest("ban.list", session)
+	if len(received) != 2 || received[0] != "storage.list" || received[1] != "ban.list" {
+		t.Errorf("Expected only read-only commands upstream but received %#v.", received)
+	}
+	if actual := mockWriter.String(); !strings.Contains(actual, "Dry run, not passed through") || !strings.Contains(actual, "req.url ~ /") {
+		t.Errorf("Expected the mutating command to be held back but was %#v.", actual)
+	}
+}
+
+func TestVarnishCliPoolDoesNotResendCommandAfterFailedRead(t *testing.T) {
+	netListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netListener.Close()
+	received := make(chan string, 10)
+	go func() {
+		for {
+			connection, err := netListener.Accept()
+			if err != nil {
+				return
+			}
+			go func(connection net.Conn) {
+				defer connection.Close()
+				writeVarnishCliResponse(connection, CLIS_OK, "Varnish Cache CLI 1.0")
+				scanner := bufio.NewScanner(connection)
+				for scanner.Scan() {
+					received <- scanner.Text()
+					if strings.HasPrefix(scanner.Text(), "ban ") {
+						// the connection drops once varnishd has the command
+						return
+					}
+					writeVarnishCliResponse(connection, CLIS_OK, "PONG")
+				}
+			}(connection)
+		}
+	}()
+
+	pool := &varnishCliPool{Address: netListener.Addr().String()}
+	if _, err := pool.command("ping"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.command(`ban req.url ~ /`); err == nil {
+		t.Errorf("Expected the dropped connection to fail the command.")
+	}
+	if commands := []string{<-received, <-received}; commands[1] != "ban req.url ~ /" {
+		t.Errorf("Expected the ban to be received but was %#v.", commands)
+	}
+	select {
+	case command := <-received:
+		t.Errorf("Expected the ban to be sent once but %#v was sent again.", command)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// pendingVclDeployment is a deployment requested with vcl.use or
+// vcl.rollback that waits for an approver before it is posted to section.io.
+type pendingVclDeployment struct {
+	ID            string
+	ConfigName    string
+	Personality   string
+	Content       string
+	Identity      string
+	ClientAddress string
+	DryRun        bool
+	Requested     time.Time
+	Expires       time.Time
+}
+
+// vclApprovalQueue holds the pending deployments of a listener in the order
+// they were requested. Expired deployments are dropped whenever the queue is
+// accessed.
+type vclApprovalQueue struct {
+	mutex   sync.Mutex
+	pending []*pendingVclDeployment
+}
+
+// vclApprovalRequired is true when approver secrets are configured, in which
+// case deployments need a second person's approval.
+func vclApprovalRequired() bool {
+	return len(approverSecrets) > 0
+}
+
+func newVclApprovalID() (string, error) {
+	idBytes := make([]byte, 8)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(idBytes), nil
+}
+
+// expire drops deployments whose approval time has passed. The caller must
+// hold the mutex.
+func (queue *vclApprovalQueue) expire(now time.Time) {
+	remaining := queue.pending[:0]
+	for _, deployment := range queue.pending {
+		if now.After(deployment.Expires) {
+			log.Printf("Pending deployment %s of VCL '%s' expired without approval.", deployment.ID, deployment.ConfigName)
+			continue
+		}
+		remaining = append(remaining, deployment)
+	}
+	for index := len(remaining); index < len(queue.pending); index++ {
+		queue.pending[index] = nil
+	}
+	queue.pending = remaining
+}
+
+func (queue *vclApprovalQueue) add(deployment pendingVclDeployment) (pendingVclDeployment, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	id, err := newVclApprovalID()
+	if err != nil {
+		return pendingVclDeployment{}, err
+	}
+	deployment.ID = id
+	deployment.Requested = time.Now().UTC()
+	deployment.Expires = deployment.Requested.Add(vclApprovalTimeout)
+
+	queue.expire(deployment.Requested)
+	queue.pending = append(queue.pending, &deployment)
+	return deployment, nil
+}
+
+func (queue *vclApprovalQueue) get(id string) (pendingVclDeployment, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.expire(time.Now().UTC())
+	for _, deployment := range queue.pending {
+		if deployment.ID == id {
+			return *deployment, true
+		}
+	}
+	return pendingVclDeployment{}, false
+}
+
+// remove takes a deployment out of the queue, returning false if it is no
+// longer pending.
+func (queue *vclApprovalQueue) remove(id string) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.expire(time.Now().UTC())
+	for index, deployment := range queue.pending {
+		if deployment.ID == id {
+			copy(queue.pending[index:], queue.pending[index+1:])
+			queue.pending[len(queue.pending)-1] = nil
+			queue.pending = queue.pending[:len(queue.pending)-1]
+			return true
+		}
+	}
+	return false
+}
+
+func (queue *vclApprovalQueue) list() []pendingVclDeployment {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.expire(time.Now().UTC())
+	result := make([]pendingVclDeployment, 0, len(queue.pending))
+	for _, deployment := range queue.pending {
+		result = append(result, *deployment)
+	}
+	return result
+}
+
+// queueVclDeployment puts a deployment into the approval queue in place of
+// deploying it, and writes the CLI response with its reference ID. Any
+// response text, such as policy warnings, is appended.
+func queueVclDeployment(session *varnishCliSession, configName string, personality string, content string, response string) {
+	deployment, err := session.Listener.approvals.add(pendingVclDeployment{
+		ConfigName:    configName,
+		Personality:   personality,
+		Content:       content,
+		Identity:      session.Identity,
+		ClientAddress: session.RemoteAddress,
+		DryRun:        session.DryRun,
+	})
+	if err != nil {
+		log.Printf("Error queueing VCL '%s' for approval: %v", configName, err)
+		writeVarnishCliResponse(session.Writer, CLIS_CANT, "Failed to queue the deployment for approval.")
+		return
+	}
+	log.Printf("Deployment %s of VCL '%s' by %s is pending approval.", deployment.ID, configName, session.Identity)
+
+	message := fmt.Sprintf("Deployment of VCL '%s' is pending approval with reference %s.", configName, deployment.ID)
+	if response != "" {
+		message += "\n" + response
+	}
+	writeVarnishCliResponse(session.Writer, CLIS_OK, message)
+}
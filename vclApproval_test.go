@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVclUseWaitsForApproval(t *testing.T) {
+	defer func(previous []approverSecret) { approverSecrets = previous }(approverSecrets)
+	approverSecrets = []approverSecret{{Identity: "approver", Path: "/etc/varnish/approver"}}
+	parseVclMessageTemplate("{{.ConfigName}} by {{.Identity}} approved by {{.ApprovedBy}}")
+
+	posted := []jsonUpdateVclRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method == "GET" {
+			response.Write([]byte(`{"content":""}`))
+			return
+		}
+		var body jsonUpdateVclRequest
+		json.NewDecoder(request.Body).Decode(&body)
+		posted = append(posted, body)
+		response.Write([]byte(`{"message":"ok"}`))
+	}))
+	defer server.Close()
+	listener := newTestListener("4.0", server.URL)
+
+	listener.configs.add(vclConfig{Name: "first", Source: "vcl 4.0;", Personality: "Varnish4"})
+	listener.configs.add(vclConfig{Name: "second", Source: "vcl 4.0;\nsub vcl_recv {}", Personality: "Varnish4"})
+
+	requesterWriter := new(bytes.Buffer)
+	requester := &varnishCliSession{Writer: requesterWriter, Identity: "secret", Listener: listener}
+	handleVarnishCliVclUse("first", requester)
+	handleVarnishCliVclUse("second", requester)
+	if len(posted) != 0 {
+		t.Fatalf("Expected nothing to be posted before approval but was %#v.", posted)
+	}
+	ids := regexp.MustCompile(`reference ([0-9a-f]{16})\.`).FindAllStringSubmatch(requesterWriter.String(), -1)
+	if len(ids) != 2 {
+		t.Fatalf("Expected two reference IDs but was %#v.", requesterWriter.String())
+	}
+
+	requesterWriter.Reset()
+	handleVarnishCliVclApprove(ids[0][1], requester)
+	if actual := requesterWriter.String(); !strings.HasPrefix(actual, "300 ") {
+		t.Errorf("Expected a non-approver to be refused but was %#v.", actual)
+	}
+
+	approverWriter := new(bytes.Buffer)
+	approver := &varnishCliSession{Writer: approverWriter, Identity: "approver", IsApprover: true, Listener: listener}
+	handleVarnishCliVclApprove(ids[0][1], approver)
+	if actual := approverWriter.String(); !strings.HasPrefix(actual, "200 ") {
+		t.Errorf("Expected approval to succeed but was %#v.", actual)
+	}
+	if len(posted) != 1 || posted[0].Message != "first by secret approved by approver" {
+		t.Errorf("Expected first to be posted on approval but was %#v.", posted)
+	}
+	if active := listener.configs.active(); active != "first" {
+		t.Errorf("Expected first to be active but was %#v.", active)
+	}
+
+	approverWriter.Reset()
+	handleVarnishCliVclReject(ids[1][1], approver)
+	if actual := approverWriter.String(); !strings.HasPrefix(actual, "200 ") {
+		t.Errorf("Expected rejection to succeed but was %#v.", actual)
+	}
+	if len(posted) != 1 || len(listener.approvals.list()) != 0 {
+		t.Errorf("Expected the rejected deployment to be discarded but was %#v.", listener.approvals.list())
+	}
+}
+
+func TestVclApprovalSelfApprovalAndExpiry(t *testing.T) {
+	defer func(previous time.Duration) { vclApprovalTimeout = previous }(vclApprovalTimeout)
+	vclApprovalTimeout = time.Hour
+	listener := newTestListener("4.0")
+
+	deployment, _ := listener.approvals.add(pendingVclDeployment{ConfigName: "boot", Identity: "approver"})
+
+	mockWriter := new(bytes.Buffer)
+	approver := &varnishCliSession{Writer: mockWriter, Identity: "approver", IsApprover: true, Listener: listener}
+	handleVarnishCliVclApprove(deployment.ID, approver)
+	if actual := mockWriter.String(); !strings.Contains(actual, "someone other than the requester") {
+		t.Errorf("Expected self-approval to be refused but was %#v.", actual)
+	}
+
+	listener.approvals.pending[0].Expires = time.Now().Add(-time.Second)
+	if pending := listener.approvals.list(); len(pending) != 0 {
+		t.Errorf("Expected the deployment to have expired but was %#v.", pending)
+	}
+
+	mockWriter.Reset()
+	approver.Identity = "other"
+	handleVarnishCliVclReject(deployment.ID, approver)
+	expected := "No pending VCL deployment " + deployment.ID + " known."
+	if actual := mockWriter.String(); !strings.Contains(actual, expected) {
+		t.Errorf("Expected %#v but was %#v.", expected, actual)
+	}
+}
+
+func TestApproverSecretsMustBeDistinct(t *testing.T) {
+	directory, err := ioutil.TempDir("", "approvers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	os.Mkdir(filepath.Join(directory, "ops"), 0755)
+	os.Mkdir(filepath.Join(directory, "release"), 0755)
+	requesterSecret := writeTestSecret(t, directory, "secret", "requester\n")
+	// the same file name as the requester secret, in another directory
+	aliceSecret := writeTestSecret(t, directory, filepath.Join("ops", "secret"), "alice\n")
+	bobSecret := writeTestSecret(t, directory, filepath.Join("release", "secret"), "bob\n")
+	copiedSecret := writeTestSecret(t, directory, "copy", "requester\n")
+
+	listener := newTestListener("4.0")
+	listener.SecretFile = requesterSecret
+	listeners := []*varnishCliListener{listener}
+
+	secrets, err := parseApproverSecrets("alice=" + aliceSecret + ", " + bobSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 2 || secrets[0].Identity != "alice" || secrets[1].Identity != bobSecret {
+		t.Fatalf("Unexpected approver secrets %#v.", secrets)
+	}
+	if err := checkApproverSecrets(secrets, listeners); err != nil {
+		t.Errorf("Expected distinct approver secrets to be accepted but got %v.", err)
+	}
+
+	for _, spec := range []string{requesterSecret, copiedSecret, aliceSecret + "," + aliceSecret, "alice=" + aliceSecret + ",alice=" + bobSecret, requesterSecret + "=" + bobSecret} {
+		secrets, _ := parseApproverSecrets(spec)
+		if err := checkApproverSecrets(secrets, listeners); err == nil {
+			t.Errorf("Expected approver secrets %#v to be refused.", spec)
+		}
+	}
+}
+
+func TestEachApproverSecretHasItsOwnIdentity(t *testing.T) {
+	defer func(previous []approverSecret) { approverSecrets = previous }(approverSecrets)
+	directory, err := ioutil.TempDir("", "approvers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	approverSecrets = []approverSecret{
+		{Identity: "alice", Path: writeTestSecret(t, directory, "alice", "alice\n")},
+		{Identity: "bob", Path: writeTestSecret(t, directory, "bob", "bob\n")},
+	}
+	listener := newTestListener("4.0")
+	listener.SecretFile = writeTestSecret(t, directory, "secret", "requester\n")
+
+	for _, secret := range approverSecrets {
+		session := &varnishCliSession{Writer: new(bytes.Buffer), Listener: listener}
+		writeVarnishCliAuthenticationChallenge(session)
+		secretBytes, _ := getVarnishSecret(secret.Path)
+		handleVarnishCliAuthenticationAttempt(computeVarnishAuthenticator(session.AuthChallenge, secretBytes), session)
+		if !session.IsApprover || session.Identity != secret.Identity {
+			t.Errorf("Expected to authenticate as approver %#v but was %#v.", secret.Identity, session)
+		}
+	}
+}
+
+func TestVclApprovalsBelongToTheirListener(t *testing.T) {
+	defer func(previous []approverSecret) { approverSecrets = previous }(approverSecrets)
+	approverSecrets = []approverSecret{{Identity: "approver", Path: "/etc/varnish/approver"}}
+	first, second := newTestListener("4.0"), newTestListener("4.0")
+	first.configs.add(vclConfig{Name: "boot", Source: "vcl 4.0;", Personality: "Varnish4"})
+
+	requesterWriter := new(bytes.Buffer)
+	handleVarnishCliVclUse("boot", &varnishCliSession{Writer: requesterWriter, Identity: "secret", Listener: first})
+	id := regexp.MustCompile(`reference ([0-9a-f]{16})\.`).FindStringSubmatch(requesterWriter.String())
+	if id == nil {
+		t.Fatalf("Expected a reference ID but was %#v.", requesterWriter.String())
+	}
+
+	mockWriter := new(bytes.Buffer)
+	approver := &varnishCliSession{Writer: mockWriter, Identity: "approver", IsApprover: true, Listener: second}
+	handleVarnishCliVclPending(approver)
+	if actual := mockWriter.String(); actual != "200 0       \n\n" {
+		t.Errorf("Expected no pending deployments on the other listener but was %#v.", actual)
+	}
+	mockWriter.Reset()
+	handleVarnishCliVclApprove(id[1], approver)
+	if actual := mockWriter.String(); !strings.HasPrefix(actual, "106 ") || len(first.approvals.list()) != 1 {
+		t.Errorf("Expected approval on the other listener to be refused but was %#v.", actual)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxVclHistory bounds how many deployments are kept, oldest dropped first.
+const maxVclHistory = 100
+
+type vclDeployment struct {
+	Revision      int                    `json:"revision"`
+	ConfigName    string                 `json:"configName"`
+	Personality   string                 `json:"personality"`
+	Content       string                 `json:"content"`
+	ContentHash   string                 `json:"contentHash"`
+	Time          time.Time              `json:"time"`
+	Identity      string                 `json:"identity"`
+	ClientAddress string                 `json:"clientAddress"`
+	ApprovedBy    string                 `json:"approvedBy,omitempty"`
+	Response      map[string]interface{} `json:"response"`
+	Failures      map[string]string      `json:"failures,omitempty"`
+}
+
+// vclHistoryLog records every VCL successfully deployed to section.io so that
+// an earlier revision can be deployed again with vcl.rollback.
+type vclHistoryLog struct {
+	mutex       sync.Mutex
+	deployments []*vclDeployment
+	statePath   string
+}
+
+// record adds a deployment to the history, returning it with its revision.
+// The deployment is kept in memory when saving fails.
+func (history *vclHistoryLog) record(deployment vclDeployment) (vclDeployment, error) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	deployment.Revision = 1
+	if count := len(history.deployments); count > 0 {
+		deployment.Revision = history.deployments[count-1].Revision + 1
+	}
+	history.deployments = append(history.deployments, &deployment)
+	if len(history.deployments) > maxVclHistory {
+		history.deployments = history.deployments[len(history.deployments)-maxVclHistory:]
+	}
+	return deployment, history.save()
+}
+
+func (history *vclHistoryLog) latest() (deployment vclDeployment, ok bool) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	if len(history.deployments) == 0 {
+		return vclDeployment{}, false
+	}
+	return *history.deployments[len(history.deployments)-1], true
+}
+
+func (history *vclHistoryLog) get(revision int) (deployment vclDeployment, ok bool) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	for _, deployment := range history.deployments {
+		if deployment.Revision == revision {
+			return *deployment, true
+		}
+	}
+	return vclDeployment{}, false
+}
+
+func (history *vclHistoryLog) list() []vclDeployment {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	deployments := make([]vclDeployment, 0, len(history.deployments))
+	for _, deployment := range history.deployments {
+		deployments = append(deployments, *deployment)
+	}
+	return deployments
+}
+
+// load restores the history from the state file at path, if it exists, and
+// saves all subsequent deployments there.
+func (history *vclHistoryLog) load(path string) error {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	history.statePath = path
+
+	stateBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read VCL history state file '%s': %v", path, err)
+	}
+
+	err = json.Unmarshal(stateBytes, &history.deployments)
+	if err != nil {
+		return fmt.Errorf("Failed to parse VCL history state file '%s': %v", path, err)
+	}
+	return nil
+}
+
+// save must be called with the mutex held.
+func (history *vclHistoryLog) save() error {
+	if history.statePath == "" {
+		return nil
+	}
+
+	stateBytes, err := json.Marshal(history.deployments)
+	if err == nil {
+		err = writeFileAtomically(history.statePath, stateBytes)
+	}
+	if err != nil {
+		log.Printf("Error saving VCL history state to '%s': %v", history.statePath, err)
+		return fmt.Errorf("Failed to save the VCL history state.")
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVclUseRecordsHistoryAndSkipsIdenticalContent(t *testing.T) {
+	parseVclMessageTemplate("{{.ConfigName}} by {{.Identity}}")
+
+	posted := []jsonUpdateVclRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method == "GET" {
+			deployed := ""
+			if len(posted) > 0 {
+				deployed = posted[len(posted)-1].Content
+			}
+			json.NewEncoder(response).Encode(map[string]string{"content": deployed})
+			return
+		}
+		var body jsonUpdateVclRequest
+		json.NewDecoder(request.Body).Decode(&body)
+		posted = append(posted, body)
+		response.Write([]byte(`{"message":"ok"}`))
+	}))
+	defer server.Close()
+	listener := newTestListener("4.0", server.URL)
+
+	listener.configs.add(vclConfig{Name: "first", Source: "vcl 4.0;", Personality: "Varnish4"})
+	listener.configs.add(vclConfig{Name: "same", Source: "vcl 4.0;", Personality: "Varnish4"})
+	listener.configs.add(vclConfig{Name: "second", Source: "vcl 4.0;\nsub vcl_recv {}", Personality: "Varnish4"})
+
+	mockWriter := new(bytes.Buffer)
+	session := &varnishCliSession{Writer: mockWriter, Identity: "secret", Listener: listener}
+	for _, name := range []string{"first", "same", "second"} {
+		handleVarnishCliVclUse(name, session)
+	}
+	if len(posted) != 2 || posted[0].Message != "first by secret" || posted[1].Message != "second by secret" {
+		t.Errorf("Expected first and second to be posted but was %#v.", posted)
+	}
+	if active := listener.configs.active(); active != "second" {
+		t.Errorf("Expected second to be active but was %#v.", active)
+	}
+
+	deployments := listener.history.list()
+	if len(deployments) != 2 || deployments[0].Revision != 1 || deployments[1].Revision != 2 {
+		t.Fatalf("Expected two revisions in the history but was %#v.", deployments)
+	}
+	if deployments[1].Identity != "secret" || deployments[1].Response["message"] != "ok" {
+		t.Errorf("Expected identity and API response to be recorded but was %#v.", deployments[1])
+	}
+
+	mockWriter.Reset()
+	handleVarnishCliVclRollback("1", session)
+	if actual := mockWriter.String(); !strings.HasPrefix(actual, "200 ") {
+		t.Errorf("Expected rollback to succeed but was %#v.", actual)
+	}
+	if len(posted) != 3 || posted[2].Content != "vcl 4.0;" {
+		t.Errorf("Expected rollback to post revision 1 content but was %#v.", posted)
+	}
+	if active := listener.configs.active(); active != "first" {
+		t.Errorf("Expected first to be active after rollback but was %#v.", active)
+	}
+}
+
+func TestVclUseComparesWithDeployedVcl(t *testing.T) {
+	parseVclMessageTemplate("Update")
+	backend := &fakeBackend{}
+	listener := newTestListener("4.0")
+	listener.backend = backend
+	listener.configs.add(vclConfig{Name: "boot", Source: "vcl 4.0;", Personality: "Varnish4"})
+
+	session := &varnishCliSession{Writer: new(bytes.Buffer), Listener: listener}
+	handleVarnishCliVclUse("boot", session)
+	handleVarnishCliVclUse("boot", session)
+	if len(backend.deploys) != 1 {
+		t.Errorf("Expected identical content to be skipped but was deployed %d times.", len(backend.deploys))
+	}
+
+	// as when the VCL is changed in the section.io UI
+	backend.deployed = "vcl 4.0;\nsub vcl_recv {}"
+	handleVarnishCliVclUse("boot", session)
+	if len(backend.deploys) != 2 {
+		t.Errorf("Expected content differing from the deployed VCL to be deployed but was deployed %d times.", len(backend.deploys))
+	}
+}
+
+func TestVclUseRetriesPartiallyFailedDeployment(t *testing.T) {
+	parseVclMessageTemplate("Update")
+	backend := &fakeBackend{failures: map[string]string{"https://second.example": "500"}}
+	listener := newTestListener("4.0")
+	listener.backend = backend
+	listener.configs.add(vclConfig{Name: "boot", Source: "vcl 4.0;", Personality: "Varnish4"})
+
+	session := &varnishCliSession{Writer: new(bytes.Buffer), Listener: listener}
+	handleVarnishCliVclUse("boot", session)
+	backend.failures = nil
+	handleVarnishCliVclUse("boot", session)
+	if len(backend.deploys) != 2 {
+		t.Errorf("Expected the partially failed deployment to be retried but was deployed %d times.", len(backend.deploys))
+	}
+	handleVarnishCliVclUse("boot", session)
+	if len(backend.deploys) != 2 {
+		t.Errorf("Expected the complete deployment to be skipped but was deployed %d times.", len(backend.deploys))
+	}
+}
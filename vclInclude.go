@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const maxVclIncludeDepth = 10
+
+// flattenVclIncludes replaces each include statement with the content of the
+// named file from the VCL directory, recursively, returning the result and
+// the files that were included. The path of the source itself is empty for
+// vcl.inline.
+func flattenVclIncludes(source string, path string) (string, []string, error) {
+	stack := []string{}
+	if path != "" {
+		stack = append(stack, path)
+	}
+	included := []string{}
+	flattened, err := flattenVclIncludesFrom(source, stack, 0, &included)
+	return flattened, included, err
+}
+
+func flattenVclIncludesFrom(source string, stack []string, depth int, included *[]string) (string, error) {
+	tokens, syntaxError := lexVcl(source)
+	if syntaxError != nil {
+		return "", syntaxError
+	}
+
+	var result bytes.Buffer
+	previous := 0
+	for index := 0; index+2 < len(tokens); index++ {
+		if tokens[index].Type != vclTokenIdent || tokens[index].Text != "include" ||
+			tokens[index+1].Type != vclTokenString || tokens[index+2].Text != ";" {
+			continue
+		}
+		name := vclStringValue(tokens[index+1])
+
+		if depth >= maxVclIncludeDepth {
+			return "", fmt.Errorf("Include depth limit of %d exceeded at '%s'", maxVclIncludeDepth, name)
+		}
+		path, err := resolveVclPath(name)
+		if err != nil {
+			return "", fmt.Errorf("Cannot read include file '%s'", name)
+		}
+		for _, ancestor := range stack {
+			if ancestor == path {
+				return "", fmt.Errorf("Include cycle: %s -> %s", strings.Join(relativeVclPaths(stack), " -> "), name)
+			}
+		}
+		contentBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("Cannot read include file '%s'", name)
+		}
+
+		content, err := stripVclVersionDeclaration(string(contentBytes))
+		if err != nil {
+			return "", fmt.Errorf("Include file '%s': %v", name, err)
+		}
+		*included = append(*included, name)
+		content, err = flattenVclIncludesFrom(content, append(stack, path), depth+1, included)
+		if err != nil {
+			return "", err
+		}
+
+		result.WriteString(source[previous:tokens[index].Start])
+		result.WriteString(content)
+		previous = tokens[index+2].End
+		index += 2
+	}
+	result.WriteString(source[previous:])
+	return result.String(), nil
+}
+
+// stripVclVersionDeclaration removes the "vcl X.Y;" an included file may
+// start with, as only the top-level file may declare it once flattened.
+func stripVclVersionDeclaration(source string) (string, error) {
+	start, end, found, err := findVclVersionDeclaration(source)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return source, nil
+	}
+	return source[:start] + source[end:], nil
+}
+
+func relativeVclPaths(paths []string) []string {
+	relative := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if name, err := filepath.Rel(vclDirectory, path); err == nil {
+			path = name
+		}
+		relative = append(relative, path)
+	}
+	return relative
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func withVclDirectory(t *testing.T, files map[string]string) func() {
+	previous := vclDirectory
+	directory, err := ioutil.TempDir("", "vcl-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(directory, name)), 0755)
+		ioutil.WriteFile(filepath.Join(directory, name), []byte(content), 0644)
+	}
+	vclDirectory = directory
+	return func() {
+		vclDirectory = previous
+		os.RemoveAll(directory)
+	}
+}
+
+func TestFlattenVclIncludes(t *testing.T) {
+	defer withVclDirectory(t, map[string]string{
+		"backends.vcl":   "vcl 4.0;\nbackend default { .host = \"127.0.0.1\"; }\n",
+		"recv.vcl":       "include \"common/url.vcl\";\n",
+		"common/url.vcl": "set req.url = regsub(req.url, \"\\?$\", \"\");\n",
+	})()
+
+	source := "vcl 4.0;\ninclude \"backends.vcl\";\nsub vcl_recv {\n    include \"recv.vcl\";\n}\n"
+	actual, included, err := flattenVclIncludes(source, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "vcl 4.0;\n\nbackend default { .host = \"127.0.0.1\"; }\n\nsub vcl_recv {\n    set req.url = regsub(req.url, \"\\?$\", \"\");\n\n\n}\n"
+	if actual != expected {
+		t.Errorf("Expected flattened VCL %#v but was %#v.", expected, actual)
+	}
+	if expectedIncluded := []string{"backends.vcl", "recv.vcl", "common/url.vcl"}; !reflect.DeepEqual(included, expectedIncluded) {
+		t.Errorf("Expected included files %#v but were %#v.", expectedIncluded, included)
+	}
+	if _, err := parseVcl(actual, 4); err != nil {
+		t.Errorf("Expected flattened VCL to parse but got %v.", err)
+	}
+}
+
+func TestFlattenVclIncludesErrors(t *testing.T) {
+	defer withVclDirectory(t, map[string]string{
+		"a.vcl":    "include \"b.vcl\";",
+		"b.vcl":    "include \"a.vcl\";",
+		"self.vcl": "include \"self.vcl\";",
+	})()
+
+	testFlattenVclIncludesError(t, "include \"missing.vcl\";", "", "Cannot read include file 'missing.vcl'")
+	testFlattenVclIncludesError(t, "include \"a.vcl\";", "", "Include cycle: a.vcl -> b.vcl -> a.vcl")
+	testFlattenVclIncludesError(t, "include \"../escape.vcl\";", "", "Cannot read include file '../escape.vcl'")
+
+	selfPath, _ := resolveVclPath("self.vcl")
+	testFlattenVclIncludesError(t, "include \"self.vcl\";", selfPath, "Include cycle: self.vcl -> self.vcl")
+}
+
+func TestFlattenVclIncludesDepthLimit(t *testing.T) {
+	files := map[string]string{}
+	for depth := 0; depth <= maxVclIncludeDepth; depth++ {
+		files[filepath.Join(strings.Repeat("d/", depth), "x.vcl")] = "include \"" + strings.Repeat("d/", depth+1) + "x.vcl\";"
+	}
+	defer withVclDirectory(t, files)()
+
+	testFlattenVclIncludesError(t, "include \"x.vcl\";", "", "Include depth limit of 10 exceeded")
+}
+
+func testFlattenVclIncludesError(t *testing.T, source string, path string, message string) {
+	_, _, err := flattenVclIncludes(source, path)
+	if err == nil || !strings.HasPrefix(err.Error(), message) {
+		t.Errorf("Expected flattening %#v to fail with %#v but was %v.", source, message, err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type vclTokenType int
+
+const (
+	vclTokenEOF vclTokenType = iota
+	vclTokenIdent
+	vclTokenNumber
+	vclTokenString
+	vclTokenInlineC
+	vclTokenPunct
+)
+
+type vclToken struct {
+	Type   vclTokenType
+	Text   string
+	Start  int // byte offset of the first character
+	End    int // byte offset after the last character
+	Line   int
+	Column int
+}
+
+// vclSyntaxError is a problem found in VCL source, located at the token or
+// position the VCC compiler would point at.
+type vclSyntaxError struct {
+	Message string
+	Offset  int
+	Length  int
+	Line    int
+	Column  int
+}
+
+func (err *vclSyntaxError) Error() string {
+	return fmt.Sprintf("%s (Line %d Pos %d)", err.Message, err.Line, err.Column)
+}
+
+// multi-character operators, longest first
+var vclOperators = []string{
+	"==", "!=", "<=", ">=", "&&", "||", "!~", "+=", "-=", "*=", "/=", "++", "--",
+}
+
+const vclPunctuation = "{}();=!~<>+-*/,.&|%[]:"
+
+func isVclIdentStart(char byte) bool {
+	return (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z')
+}
+
+func isVclIdentChar(char byte) bool {
+	return isVclIdentStart(char) || isVclDigit(char) || char == '_' || char == '-' || char == '.'
+}
+
+func isVclDigit(char byte) bool {
+	return char >= '0' && char <= '9'
+}
+
+type vclLexer struct {
+	source string
+	offset int
+	line   int
+	column int
+}
+
+func (lexer *vclLexer) errorAt(offset int, line int, column int, format string, args ...interface{}) *vclSyntaxError {
+	return &vclSyntaxError{Message: fmt.Sprintf(format, args...), Offset: offset, Length: 1, Line: line, Column: column}
+}
+
+// advance moves the position forward by count bytes, tracking lines.
+func (lexer *vclLexer) advance(count int) {
+	for ; count > 0 && lexer.offset < len(lexer.source); count-- {
+		if lexer.source[lexer.offset] == '\n' {
+			lexer.line++
+			lexer.column = 1
+		} else {
+			lexer.column++
+		}
+		lexer.offset++
+	}
+}
+
+func (lexer *vclLexer) hasPrefix(prefix string) bool {
+	return strings.HasPrefix(lexer.source[lexer.offset:], prefix)
+}
+
+// skipUntil advances past the next occurrence of terminator, returning false
+// if the source ends first.
+func (lexer *vclLexer) skipUntil(terminator string) bool {
+	index := strings.Index(lexer.source[lexer.offset:], terminator)
+	if index < 0 {
+		lexer.advance(len(lexer.source) - lexer.offset)
+		return false
+	}
+	lexer.advance(index + len(terminator))
+	return true
+}
+
+// lexVcl splits VCL source into tokens, discarding whitespace and comments,
+// following the rules of the VCC compiler's tokenizer.
+func lexVcl(source string) ([]vclToken, *vclSyntaxError) {
+	lexer := &vclLexer{source: source, line: 1, column: 1}
+	tokens := []vclToken{}
+
+	for lexer.offset < len(source) {
+		char := source[lexer.offset]
+		start, line, column := lexer.offset, lexer.line, lexer.column
+
+		switch {
+		case char == ' ' || char == '\t' || char == '\r' || char == '\n':
+			lexer.advance(1)
+			continue
+		case char == '#' || lexer.hasPrefix("//"):
+			lexer.skipUntil("\n")
+			continue
+		case lexer.hasPrefix("/*"):
+			if !lexer.skipUntil("*/") {
+				return nil, lexer.errorAt(start, line, column, "Unterminated /* ... */ comment, starting at")
+			}
+			continue
+		}
+
+		tokenType := vclTokenPunct
+		switch {
+		case lexer.hasPrefix("C{"):
+			tokenType = vclTokenInlineC
+			if !lexer.skipUntil("}C") {
+				return nil, lexer.errorAt(start, line, column, "Unterminated inline C source, starting at")
+			}
+		case lexer.hasPrefix(`{"`):
+			tokenType = vclTokenString
+			if !lexer.skipUntil(`"}`) {
+				return nil, lexer.errorAt(start, line, column, "Unterminated long-string, starting at")
+			}
+		case char == '"':
+			tokenType = vclTokenString
+			end := strings.IndexAny(source[lexer.offset+1:], "\"\n")
+			if end < 0 || source[lexer.offset+1+end] == '\n' {
+				return nil, lexer.errorAt(start, line, column, "Unterminated string at")
+			}
+			lexer.advance(end + 2)
+		case isVclIdentStart(char):
+			tokenType = vclTokenIdent
+			lexer.advance(1)
+			for lexer.offset < len(source) && isVclIdentChar(source[lexer.offset]) {
+				lexer.advance(1)
+			}
+		case isVclDigit(char):
+			tokenType = vclTokenNumber
+			for lexer.offset < len(source) && (isVclDigit(source[lexer.offset]) || source[lexer.offset] == '.') {
+				lexer.advance(1)
+			}
+		default:
+			matched := false
+			for _, operator := range vclOperators {
+				if lexer.hasPrefix(operator) {
+					lexer.advance(len(operator))
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				if strings.IndexByte(vclPunctuation, char) < 0 {
+					return nil, lexer.errorAt(start, line, column, "Syntax error at")
+				}
+				lexer.advance(1)
+			}
+		}
+
+		tokens = append(tokens, vclToken{
+			Type:   tokenType,
+			Text:   source[start:lexer.offset],
+			Start:  start,
+			End:    lexer.offset,
+			Line:   line,
+			Column: column,
+		})
+	}
+
+	tokens = append(tokens, vclToken{
+		Type:   vclTokenEOF,
+		Start:  len(source),
+		End:    len(source),
+		Line:   lexer.line,
+		Column: lexer.column,
+	})
+	return tokens, nil
+}
+
+// vclStringValue returns the content of a string token without its quotes.
+func vclStringValue(token vclToken) string {
+	if strings.HasPrefix(token.Text, `{"`) {
+		return token.Text[2 : len(token.Text)-2]
+	}
+	return token.Text[1 : len(token.Text)-1]
+}
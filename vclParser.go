@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// vclProgram is the outline of a VCL source, enough to check its syntax and
+// to evaluate policy rules against it. Expressions are not broken down.
+type vclProgram struct {
+	Version      string
+	Declarations []*vclDeclaration
+	// the files whose include statements were replaced by their content
+	Includes []string
+}
+
+type vclDeclaration struct {
+	Kind       string // vcl, import, include, backend, director, probe, acl, sub or C
+	Name       string
+	Token      vclToken
+	Statements []*vclStatement // only for sub
+}
+
+type vclStatement struct {
+	Kind   string // the leading keyword, eg if, set, return, call, include, or C for inline C
+	Token  vclToken
+	Action string // the action of a return statement
+	Name   string // the file of an include statement
+	// the branches of an if statement, or the content of a nested block
+	Blocks [][]*vclStatement
+}
+
+type vclParser struct {
+	tokens []vclToken
+	index  int
+	// vcl4 selects the Varnish 4 grammar over the Varnish 3 one
+	vcl4 bool
+}
+
+func (parser *vclParser) peek() vclToken {
+	return parser.tokens[parser.index]
+}
+
+func (parser *vclParser) next() vclToken {
+	token := parser.tokens[parser.index]
+	if token.Type != vclTokenEOF {
+		parser.index++
+	}
+	return token
+}
+
+func describeVclToken(token vclToken) string {
+	if token.Type == vclTokenEOF {
+		return "EOF"
+	}
+	return "'" + token.Text + "'"
+}
+
+func vclErrorAt(token vclToken, format string, args ...interface{}) *vclSyntaxError {
+	length := len(token.Text)
+	if length == 0 {
+		length = 1
+	}
+	return &vclSyntaxError{
+		Message: fmt.Sprintf(format, args...),
+		Offset:  token.Start,
+		Length:  length,
+		Line:    token.Line,
+		Column:  token.Column,
+	}
+}
+
+func (parser *vclParser) expect(text string) (vclToken, *vclSyntaxError) {
+	token := parser.peek()
+	if token.Text != text || token.Type == vclTokenString {
+		return token, vclErrorAt(token, "Expected '%s' got %s", text, describeVclToken(token))
+	}
+	return parser.next(), nil
+}
+
+func (parser *vclParser) expectType(tokenType vclTokenType, description string) (vclToken, *vclSyntaxError) {
+	token := parser.peek()
+	if token.Type != tokenType {
+		return token, vclErrorAt(token, "Expected %s got %s", description, describeVclToken(token))
+	}
+	return parser.next(), nil
+}
+
+// parseVcl checks the syntax of VCL source against the grammar of the given
+// Varnish version and returns its outline. Source declaring a VCL version is
+// parsed with the grammar of that version.
+func parseVcl(source string, varnishMajorVersion int) (*vclProgram, *vclSyntaxError) {
+	tokens, syntaxError := lexVcl(source)
+	if syntaxError != nil {
+		return nil, syntaxError
+	}
+	parser := &vclParser{tokens: tokens, vcl4: varnishMajorVersion >= 4}
+	return parser.parseProgram()
+}
+
+func (parser *vclParser) parseProgram() (*vclProgram, *vclSyntaxError) {
+	program := &vclProgram{}
+
+	if parser.peek().Text == "vcl" {
+		declaration := &vclDeclaration{Kind: "vcl", Token: parser.next()}
+		version, err := parser.expectType(vclTokenNumber, "VCL version")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parser.expect(";"); err != nil {
+			return nil, err
+		}
+		if version.Text != "4.0" && version.Text != "4.1" {
+			return nil, vclErrorAt(version, "VCL version %s not supported.", version.Text)
+		}
+		program.Version = version.Text
+		parser.vcl4 = true
+		declaration.Name = version.Text
+		program.Declarations = append(program.Declarations, declaration)
+	} else if parser.vcl4 {
+		return nil, vclErrorAt(parser.peek(), "VCL version declaration missing\n"+
+			"Update your VCL to Version 4 syntax, and add\n"+
+			"\tvcl 4.0;\n"+
+			"on the first line the VCL files.")
+	}
+
+	for parser.peek().Type != vclTokenEOF {
+		declaration, err := parser.parseDeclaration()
+		if err != nil {
+			return nil, err
+		}
+		program.Declarations = append(program.Declarations, declaration)
+	}
+	return program, nil
+}
+
+func (parser *vclParser) topLevelKeywords() []string {
+	if parser.vcl4 {
+		return []string{"acl", "sub", "backend", "probe", "import", "include"}
+	}
+	return []string{"acl", "sub", "backend", "director", "probe", "import", "include"}
+}
+
+func (parser *vclParser) parseDeclaration() (*vclDeclaration, *vclSyntaxError) {
+	token := parser.peek()
+	declaration := &vclDeclaration{Kind: token.Text, Token: token}
+
+	if token.Type == vclTokenInlineC {
+		parser.next()
+		declaration.Kind = "C"
+		return declaration, nil
+	}
+
+	known := false
+	if token.Type == vclTokenIdent {
+		for _, keyword := range parser.topLevelKeywords() {
+			if token.Text == keyword {
+				known = true
+			}
+		}
+	}
+	if !known {
+		quoted := []string{}
+		for _, keyword := range parser.topLevelKeywords() {
+			quoted = append(quoted, "'"+keyword+"'")
+		}
+		return nil, vclErrorAt(token, "Expected one of\n\t%s or %s\nFound: %s at",
+			strings.Join(quoted[:len(quoted)-1], ", "), quoted[len(quoted)-1], describeVclToken(token))
+	}
+	parser.next()
+
+	switch token.Text {
+	case "include":
+		name, err := parser.expectType(vclTokenString, "a string")
+		if err != nil {
+			return nil, err
+		}
+		declaration.Name = vclStringValue(name)
+		_, err = parser.expect(";")
+		return declaration, err
+	case "import":
+		name, err := parser.expectType(vclTokenIdent, "an identifier")
+		if err != nil {
+			return nil, err
+		}
+		declaration.Name = name.Text
+		if parser.peek().Text == "from" {
+			parser.next()
+			if _, err := parser.expectType(vclTokenString, "a string"); err != nil {
+				return nil, err
+			}
+		}
+		_, err = parser.expect(";")
+		return declaration, err
+	}
+
+	name, err := parser.expectType(vclTokenIdent, "an identifier")
+	if err != nil {
+		return nil, err
+	}
+	declaration.Name = name.Text
+
+	switch token.Text {
+	case "sub":
+		if _, err := parser.expect("{"); err != nil {
+			return nil, err
+		}
+		declaration.Statements, err = parser.parseStatements()
+		return declaration, err
+	case "director":
+		if _, err := parser.expectType(vclTokenIdent, "a director type"); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := parser.expect("{"); err != nil {
+		return nil, err
+	}
+	return declaration, parser.skipBalanced("}")
+}
+
+// skipBalanced consumes tokens up to and including closing, which must not be
+// nested inside other brackets.
+func (parser *vclParser) skipBalanced(closing string) *vclSyntaxError {
+	pairs := map[string]string{"{": "}", "(": ")", "[": "]"}
+	expected := []string{closing}
+	for len(expected) > 0 {
+		token := parser.next()
+		if token.Type == vclTokenEOF {
+			return vclErrorAt(token, "Expected '%s' got EOF", expected[len(expected)-1])
+		}
+		if token.Type != vclTokenPunct {
+			continue
+		}
+		if nested, ok := pairs[token.Text]; ok {
+			expected = append(expected, nested)
+		} else if token.Text == "}" || token.Text == ")" || token.Text == "]" {
+			if token.Text != expected[len(expected)-1] {
+				return vclErrorAt(token, "Expected '%s' got %s", expected[len(expected)-1], describeVclToken(token))
+			}
+			expected = expected[:len(expected)-1]
+		}
+	}
+	return nil
+}
+
+// skipExpression consumes tokens up to, but not including, a ';' outside of
+// any brackets, refusing to run into the end of the enclosing block.
+func (parser *vclParser) skipExpression() *vclSyntaxError {
+	for {
+		token := parser.peek()
+		switch {
+		case token.Type == vclTokenEOF || (token.Type == vclTokenPunct && (token.Text == "{" || token.Text == "}")):
+			return vclErrorAt(token, "Expected ';' got %s", describeVclToken(token))
+		case token.Type == vclTokenPunct && token.Text == ";":
+			return nil
+		case token.Type == vclTokenPunct && (token.Text == "(" || token.Text == "["):
+			parser.next()
+			closing := map[string]string{"(": ")", "[": "]"}[token.Text]
+			if err := parser.skipBalanced(closing); err != nil {
+				return err
+			}
+		case token.Type == vclTokenPunct && (token.Text == ")" || token.Text == "]"):
+			return vclErrorAt(token, "Expected ';' got %s", describeVclToken(token))
+		default:
+			parser.next()
+		}
+	}
+}
+
+// parseStatements parses statements up to and including the closing brace of
+// the block whose opening brace has already been consumed.
+func (parser *vclParser) parseStatements() ([]*vclStatement, *vclSyntaxError) {
+	statements := []*vclStatement{}
+	for {
+		token := parser.peek()
+		if token.Type == vclTokenPunct && token.Text == "}" {
+			parser.next()
+			return statements, nil
+		}
+		if token.Type == vclTokenEOF {
+			return nil, vclErrorAt(token, "Expected '}' got EOF")
+		}
+		statement, err := parser.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		if statement != nil {
+			statements = append(statements, statement)
+		}
+	}
+}
+
+func (parser *vclParser) vclActionKeywords() []string {
+	if parser.vcl4 {
+		return []string{"ban", "call", "hash_data", "new", "return", "rollback", "set", "synthetic", "unset"}
+	}
+	return []string{"ban", "ban_url", "call", "error", "esi", "hash_data", "panic", "purge", "remove", "return", "rollback", "set", "synthetic", "unset"}
+}
+
+func (parser *vclParser) parseStatement() (*vclStatement, *vclSyntaxError) {
+	token := parser.peek()
+	statement := &vclStatement{Kind: token.Text, Token: token}
+
+	switch {
+	case token.Type == vclTokenPunct && token.Text == ";":
+		// empty statements are allowed
+		parser.next()
+		return nil, nil
+	case token.Type == vclTokenPunct && token.Text == "{":
+		parser.next()
+		statement.Kind = "{"
+		block, err := parser.parseStatements()
+		statement.Blocks = [][]*vclStatement{block}
+		return statement, err
+	case token.Type == vclTokenInlineC:
+		parser.next()
+		statement.Kind = "C"
+		return statement, nil
+	case token.Type == vclTokenIdent && token.Text == "if":
+		return statement, parser.parseIf(statement)
+	case token.Type == vclTokenIdent && token.Text == "return":
+		return statement, parser.parseReturn(statement)
+	case token.Type == vclTokenIdent && token.Text == "include":
+		// VCC accepts includes anywhere, not only between declarations
+		parser.next()
+		name, err := parser.expectType(vclTokenString, "a string")
+		if err != nil {
+			return nil, err
+		}
+		statement.Name = vclStringValue(name)
+		_, err = parser.expect(";")
+		return statement, err
+	case token.Type == vclTokenIdent && token.Text == "set":
+		parser.next()
+		if _, err := parser.expectType(vclTokenIdent, "a variable name"); err != nil {
+			return nil, err
+		}
+		operator := parser.peek()
+		switch operator.Text {
+		case "=", "+=", "-=", "*=", "/=":
+			parser.next()
+		default:
+			return nil, vclErrorAt(operator, "Expected '=' got %s", describeVclToken(operator))
+		}
+	case token.Type == vclTokenIdent && (token.Text == "unset" || token.Text == "remove" || token.Text == "call"):
+		parser.next()
+		if _, err := parser.expectType(vclTokenIdent, "an identifier"); err != nil {
+			return nil, err
+		}
+	case token.Type == vclTokenIdent:
+		isAction := false
+		for _, keyword := range parser.vclActionKeywords() {
+			if token.Text == keyword {
+				isAction = true
+			}
+		}
+		parser.next()
+		// anything else must be a function call, eg std.log("...");
+		if !isAction && parser.peek().Text != "(" {
+			return nil, vclErrorAt(token, "Expected an action, 'if', '{' or '}'")
+		}
+	default:
+		return nil, vclErrorAt(token, "Expected an action, 'if', '{' or '}'")
+	}
+
+	if err := parser.skipExpression(); err != nil {
+		return nil, err
+	}
+	parser.next()
+	return statement, nil
+}
+
+func (parser *vclParser) parseCondition() *vclSyntaxError {
+	if _, err := parser.expect("("); err != nil {
+		return err
+	}
+	if parser.peek().Text == ")" {
+		return vclErrorAt(parser.peek(), "Expected a condition got ')'")
+	}
+	return parser.skipBalanced(")")
+}
+
+func (parser *vclParser) parseIf(statement *vclStatement) *vclSyntaxError {
+	parser.next()
+	for {
+		if err := parser.parseCondition(); err != nil {
+			return err
+		}
+		if _, err := parser.expect("{"); err != nil {
+			return err
+		}
+		block, err := parser.parseStatements()
+		if err != nil {
+			return err
+		}
+		statement.Blocks = append(statement.Blocks, block)
+
+		token := parser.peek()
+		switch {
+		case token.Text == "elsif" || token.Text == "elseif" || token.Text == "elif":
+			parser.next()
+			continue
+		case token.Text == "else" && parser.tokens[parser.index+1].Text == "if":
+			parser.next()
+			parser.next()
+			continue
+		case token.Text == "else":
+			parser.next()
+			if _, err := parser.expect("{"); err != nil {
+				return err
+			}
+			block, err := parser.parseStatements()
+			if err != nil {
+				return err
+			}
+			statement.Blocks = append(statement.Blocks, block)
+		}
+		return nil
+	}
+}
+
+func (parser *vclParser) parseReturn(statement *vclStatement) *vclSyntaxError {
+	parser.next()
+	if _, err := parser.expect("("); err != nil {
+		return err
+	}
+	action, err := parser.expectType(vclTokenIdent, "action name")
+	if err != nil {
+		return err
+	}
+	statement.Action = action.Text
+	if parser.vcl4 && parser.peek().Text == "(" {
+		// eg return (synth(200, "OK"));
+		parser.next()
+		if err := parser.skipBalanced(")"); err != nil {
+			return err
+		}
+	}
+	if _, err := parser.expect(")"); err != nil {
+		return err
+	}
+	_, err = parser.expect(";")
+	return err
+}
+
+// formatVccError renders a syntax error the way varnishd reports VCC compiler
+// failures, pointing at the offending token within its source line.
+func formatVccError(source string, sourceName string, syntaxError *vclSyntaxError) string {
+	lineStart := strings.LastIndex(source[:syntaxError.Offset], "\n") + 1
+	lineEnd := strings.Index(source[lineStart:], "\n")
+	if lineEnd < 0 {
+		lineEnd = len(source)
+	} else {
+		lineEnd += lineStart
+	}
+	line := source[lineStart:lineEnd]
+
+	var marker bytes.Buffer
+	for index := 0; index < len(line) || lineStart+index < syntaxError.Offset+syntaxError.Length; index++ {
+		offset := lineStart + index
+		switch {
+		case offset >= syntaxError.Offset && offset < syntaxError.Offset+syntaxError.Length:
+			marker.WriteByte('#')
+		case index < len(line) && line[index] == '\t':
+			marker.WriteByte('\t')
+		default:
+			marker.WriteByte('-')
+		}
+		if offset >= lineEnd {
+			break
+		}
+	}
+
+	return fmt.Sprintf("Message from VCC-compiler:\n%s\n('%s' Line %d Pos %d)\n%s\n%s\n\n"+
+		"Running VCC-compiler failed, exited with 2\n\nVCL compilation failed",
+		syntaxError.Message, sourceName, syntaxError.Line, syntaxError.Column, line, marker.String())
+}
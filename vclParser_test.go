@@ -0,0 +1,161 @@
+package main
+
+import "testing"
+
+const varnish4Vcl = `vcl 4.0;
+
+import std;
+
+backend default {
+    .host = "127.0.0.1";
+    .port = "8080";
+}
+
+acl purge {
+    "localhost";
+    !"192.168.0.1";
+}
+
+sub vcl_recv {
+    if (req.method == "PURGE") {
+        if (!client.ip ~ purge) {
+            return (synth(405, "Not allowed."));
+        }
+        return (purge);
+    } elsif (req.url ~ "^/admin") {
+        return (pass);
+    } else if (req.http.Cookie) {
+        unset req.http.Cookie;
+    } else {
+        set req.http.X-Forwarded-For = client.ip + ", " + req.http.X-Forwarded-For;
+    }
+    std.log("recv");
+    call normalise;
+}
+
+sub normalise {
+    set req.url = regsub(req.url, "\?$", "");
+    ;
+}
+
+sub vcl_backend_error {
+    synthetic({"<html>"} + beresp.status + {"</html>"});
+    return (deliver);
+}
+`
+
+const varnish3Vcl = `backend default {
+    .host = "127.0.0.1";
+}
+
+director cluster round-robin {
+    { .backend = default; }
+}
+
+sub vcl_recv {
+    if (req.request == "BAN") {
+        ban("req.url ~ " + req.url);
+        error 200 "Banned.";
+    }
+    remove req.http.Cookie;
+    return (lookup);
+}
+`
+
+func TestParseValidVcl(t *testing.T) {
+	if _, err := parseVcl(varnish4Vcl, 4); err != nil {
+		t.Errorf("Expected Varnish 4 VCL to parse but got %v.", err)
+	}
+	if _, err := parseVcl(varnish3Vcl, 3); err != nil {
+		t.Errorf("Expected Varnish 3 VCL to parse but got %v.", err)
+	}
+}
+
+func TestParseVclOutline(t *testing.T) {
+	program, err := parseVcl(varnish4Vcl, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if program.Version != "4.0" {
+		t.Errorf("Expected version 4.0 but was %#v.", program.Version)
+	}
+	recv := program.Declarations[4]
+	if recv.Kind != "sub" || recv.Name != "vcl_recv" {
+		t.Fatalf("Expected fifth declaration to be sub vcl_recv but was %s %s.", recv.Kind, recv.Name)
+	}
+	if len(recv.Statements[0].Blocks) != 4 {
+		t.Errorf("Expected if statement to have 4 branches but had %d.", len(recv.Statements[0].Blocks))
+	}
+	if action := recv.Statements[0].Blocks[1][0].Action; action != "pass" {
+		t.Errorf("Expected elsif branch to return pass but was %#v.", action)
+	}
+}
+
+func TestParseIncludeInSub(t *testing.T) {
+	program, err := parseVcl("vcl 4.0;\nsub vcl_recv {\n    if (req.url ~ \"^/static\") {\n        include \"static.vcl\";\n    }\n    include \"recv.vcl\";\n}\n", 4)
+	if err != nil {
+		t.Fatalf("Expected includes in a sub to parse but got %v.", err)
+	}
+	includes := findIncludes(program.Declarations[1].Statements)
+	if len(includes) != 2 || includes[0].Name != "static.vcl" || includes[1].Name != "recv.vcl" {
+		t.Errorf("Expected both includes in the outline but was %#v.", includes)
+	}
+
+	testParseInvalidVcl(t, 4, "vcl 4.0;\nsub vcl_recv {\n    include recv.vcl;\n}", 3, 13, "Expected a string got 'recv.vcl'")
+}
+
+func TestParseInvalidVcl(t *testing.T) {
+	testParseInvalidVcl(t, 4, "sub vcl_recv {}", 1, 1, "VCL version declaration missing")
+	testParseInvalidVcl(t, 4, "vcl 4.0;\nsub vcl_recv {\n    foo;\n}", 3, 5, "Expected an action, 'if', '{' or '}'")
+	testParseInvalidVcl(t, 4, "vcl 4.0;\nsub vcl_recv {\n    set req.url = \"/\"\n}", 4, 1, "Expected ';' got '}'")
+	testParseInvalidVcl(t, 4, "vcl 4.0;\nsub vcl_recv {\n    return pass;\n}", 3, 12, "Expected '(' got 'pass'")
+	testParseInvalidVcl(t, 4, "vcl 4.0;\nsub vcl_recv {\n    set req.url = \"/;\n}", 3, 19, "Unterminated string at")
+	testParseInvalidVcl(t, 4, "vcl 4.0;\nsub vcl_recv {\n    return (pass);\n", 4, 1, "Expected '}' got EOF")
+	testParseInvalidVcl(t, 3, "garbage", 1, 1, "Expected one of\n\t'acl', 'sub', 'backend', 'director', 'probe', 'import' or 'include'\nFound: 'garbage' at")
+}
+
+func testParseInvalidVcl(t *testing.T, grammarVersion int, source string, line int, column int, message string) {
+	_, err := parseVcl(source, grammarVersion)
+	if err == nil {
+		t.Errorf("Expected %#v to fail to parse.", source)
+		return
+	}
+	if err.Line != line || err.Column != column || len(err.Message) < len(message) || err.Message[:len(message)] != message {
+		t.Errorf("Expected %#v to fail with %#v at %d:%d but was %#v at %d:%d.", source, message, line, column, err.Message, err.Line, err.Column)
+	}
+}
+
+func TestFormatVccError(t *testing.T) {
+	source := "vcl 4.0;\nsub vcl_recv {\n    foo;\n}"
+	_, err := parseVcl(source, 4)
+	if err == nil {
+		t.Fatal("Expected VCL to fail to parse.")
+	}
+	expected := "Message from VCC-compiler:\n" +
+		"Expected an action, 'if', '{' or '}'\n" +
+		"('<vcl.inline>' Line 3 Pos 5)\n" +
+		"    foo;\n" +
+		"----###-\n" +
+		"\n" +
+		"Running VCC-compiler failed, exited with 2\n" +
+		"\n" +
+		"VCL compilation failed"
+	if actual := formatVccError(source, "<vcl.inline>", err); actual != expected {
+		t.Errorf("Expected VCC error %#v but was %#v.", expected, actual)
+	}
+}
+
+func TestParseElifAndDeclaredVersion(t *testing.T) {
+	source := "vcl 4.0;\nsub vcl_recv {\n    if (req.url ~ \"^/a\") {\n        return (pass);\n    } elif (req.url ~ \"^/b\") {\n        return (synth(404, \"Not Found\"));\n    }\n}\n"
+	program, err := parseVcl(source, 4)
+	if err != nil {
+		t.Fatalf("Expected elif to parse but was %#v.", err)
+	}
+	if statements := program.Declarations[1].Statements; len(statements) != 1 || len(statements[0].Blocks) != 2 {
+		t.Errorf("Expected both branches of the if statement but was %#v.", statements)
+	}
+	// a Varnish 3 listener still accepts VCL declaring version 4.0
+	if _, err := parseVcl(source, 3); err != nil {
+		t.Errorf("Expected the declared version to select the grammar but was %#v.", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+)
+
+type jsonVclPersonalityRule struct {
+	Personality string `json:"personality"`
+	Pattern     string `json:"pattern"`
+}
+
+type vclPersonalityRule struct {
+	Personality string
+	Pattern     *regexp.Regexp
+}
+
+// defaultVclPersonalityRules are tried in order, so more specific signatures
+// must come before generic ones such as the VCL version declaration.
+var defaultVclPersonalityRules = []jsonVclPersonalityRule{
+	{Personality: "MagentoTurpentine", Pattern: `(?i)turpentine`},
+	{Personality: "Magento2", Pattern: `X-Magento-(Tags|Cache-Debug|Cache-Control)`},
+	{Personality: "Varnish4", Pattern: `(?m)^\s*vcl\s+4\.\d+\s*;`},
+	{Personality: "Varnish3", Pattern: `\breq\.request\b|\berror\s+\d{3}\b`},
+}
+
+var vclPersonalityRules []vclPersonalityRule
+
+func compileVclPersonalityRules(rules []jsonVclPersonalityRule) ([]vclPersonalityRule, error) {
+	compiled := make([]vclPersonalityRule, 0, len(rules))
+	for index, rule := range rules {
+		if rule.Personality == "" {
+			return nil, fmt.Errorf("VCL personality rule %d has no personality", index+1)
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("VCL personality rule %d for '%s' has an invalid pattern: %v", index+1, rule.Personality, err)
+		}
+		compiled = append(compiled, vclPersonalityRule{Personality: rule.Personality, Pattern: pattern})
+	}
+	return compiled, nil
+}
+
+func loadVclPersonalityRules(rulesFile string) error {
+	rules := defaultVclPersonalityRules
+	if rulesFile != "" {
+		rulesBytes, err := ioutil.ReadFile(rulesFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read VCL personality rules file '%s': %v", rulesFile, err)
+		}
+		rules = nil
+		err = json.Unmarshal(rulesBytes, &rules)
+		if err != nil {
+			return fmt.Errorf("Failed to parse VCL personality rules file '%s': %v", rulesFile, err)
+		}
+	}
+
+	compiled, err := compileVclPersonalityRules(rules)
+	if err != nil {
+		return err
+	}
+	vclPersonalityRules = compiled
+	return nil
+}
+
+// detectVclPersonality returns the personality configured to be used for all
+// VCL if there is one, otherwise that of the first rule matching the source,
+// or an empty string when no rule matches.
+func detectVclPersonality(source string) string {
+	if vclPersonality != "" {
+		return vclPersonality
+	}
+	for _, rule := range vclPersonalityRules {
+		if rule.Pattern.MatchString(source) {
+			return rule.Personality
+		}
+	}
+	return ""
+}
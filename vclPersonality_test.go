@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDetectVclPersonality(t *testing.T) {
+	defer func(previous string, previousRules []vclPersonalityRule) {
+		vclPersonality = previous
+		vclPersonalityRules = previousRules
+	}(vclPersonality, vclPersonalityRules)
+	vclPersonality = ""
+	if err := loadVclPersonalityRules(""); err != nil {
+		t.Fatal(err)
+	}
+
+	testDetectVclPersonality(t, "# Nexcess.net Turpentine Extension for Magento\nvcl 4.0;", "MagentoTurpentine")
+	testDetectVclPersonality(t, "vcl 4.0;\nsub vcl_recv {\n  ban(\"obj.http.X-Magento-Tags ~ \" + req.http.X-Magento-Tags-Pattern);\n}", "Magento2")
+	testDetectVclPersonality(t, "vcl 4.0;\nbackend default { .host = \"127.0.0.1\"; }", "Varnish4")
+	testDetectVclPersonality(t, "sub vcl_recv {\n  if (req.request != \"GET\") { return (pass); }\n}", "Varnish3")
+	testDetectVclPersonality(t, "this is not VCL", "")
+
+	vclPersonality = "Custom"
+	testDetectVclPersonality(t, "this is not VCL", "Custom")
+}
+
+func testDetectVclPersonality(t *testing.T, source string, expected string) {
+	if actual := detectVclPersonality(source); actual != expected {
+		t.Errorf("Expected personality of %#v to be %#v but was %#v.", source, expected, actual)
+	}
+}
+
+func TestVclUseDetectsPersonalityOfRestoredConfig(t *testing.T) {
+	defer func(previous string, previousRules []vclPersonalityRule) {
+		vclPersonality = previous
+		vclPersonalityRules = previousRules
+	}(vclPersonality, vclPersonalityRules)
+	vclPersonality = ""
+	if err := loadVclPersonalityRules(""); err != nil {
+		t.Fatal(err)
+	}
+	parseVclMessageTemplate("Update")
+
+	backend := &fakeBackend{}
+	listener := newTestListener("4.0")
+	listener.backend = backend
+	// as restored from a registry saved before personalities were stored
+	listener.configs.add(vclConfig{Name: "boot", Source: "vcl 4.0;"})
+
+	mockWriter := new(bytes.Buffer)
+	handleVarnishCliVclUse("boot", &varnishCliSession{Writer: mockWriter, Listener: listener})
+	if len(backend.deploys) != 1 || backend.deploys[0].Personality != "Varnish4" {
+		t.Errorf("Expected the personality to be detected on vcl.use but was %#v, %#v.", backend.deploys, mockWriter.String())
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	vclPolicyModeEnforce = "enforce"
+	vclPolicyModeWarn    = "warn"
+)
+
+// vclPolicy is a set of rules, separate from the syntax check, restricting
+// what VCL may be deployed through the bridge.
+type vclPolicy struct {
+	Mode                          string   `json:"mode"`
+	ForbidUnconditionalPassInRecv bool     `json:"forbidUnconditionalPassInRecv"`
+	RequiredSubs                  []string `json:"requiredSubs"`
+	RequiredIncludes              []string `json:"requiredIncludes"`
+	MaxSize                       int      `json:"maxSize"`
+	ForbidInlineC                 bool     `json:"forbidInlineC"`
+}
+
+var vclDeployPolicy *vclPolicy
+
+func loadVclPolicy(policyFile string) (*vclPolicy, error) {
+	policyBytes, err := ioutil.ReadFile(policyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read VCL policy file '%s': %v", policyFile, err)
+	}
+
+	policy := &vclPolicy{Mode: vclPolicyModeEnforce}
+	err = json.Unmarshal(policyBytes, policy)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse VCL policy file '%s': %v", policyFile, err)
+	}
+	if policy.Mode != vclPolicyModeEnforce && policy.Mode != vclPolicyModeWarn {
+		return nil, fmt.Errorf("VCL policy mode must be '%s' or '%s'", vclPolicyModeEnforce, vclPolicyModeWarn)
+	}
+	return policy, nil
+}
+
+// check returns a message for each rule the VCL violates.
+func (policy *vclPolicy) check(source string, program *vclProgram) []string {
+	violations := []string{}
+
+	if policy.MaxSize > 0 && len(source) > policy.MaxSize {
+		violations = append(violations, fmt.Sprintf("VCL is %d bytes, larger than the limit of %d bytes", len(source), policy.MaxSize))
+	}
+
+	subs := map[string]bool{}
+	includes := map[string]bool{}
+	for _, name := range program.Includes {
+		includes[name] = true
+	}
+	for _, declaration := range program.Declarations {
+		switch declaration.Kind {
+		case "sub":
+			subs[declaration.Name] = true
+			for _, statement := range findIncludes(declaration.Statements) {
+				includes[statement.Name] = true
+			}
+			if policy.ForbidUnconditionalPassInRecv && declaration.Name == "vcl_recv" {
+				for _, statement := range findUnconditionalReturns(declaration.Statements, "pass") {
+					violations = append(violations, fmt.Sprintf("return(pass) in vcl_recv without a condition (Line %d Pos %d)",
+						statement.Token.Line, statement.Token.Column))
+				}
+			}
+			if policy.ForbidInlineC {
+				for _, statement := range findInlineC(declaration.Statements) {
+					violations = append(violations, fmt.Sprintf("Inline C is not allowed (Line %d Pos %d)",
+						statement.Token.Line, statement.Token.Column))
+				}
+			}
+		case "include":
+			includes[declaration.Name] = true
+		case "C":
+			if policy.ForbidInlineC {
+				violations = append(violations, fmt.Sprintf("Inline C is not allowed (Line %d Pos %d)",
+					declaration.Token.Line, declaration.Token.Column))
+			}
+		}
+	}
+
+	for _, name := range policy.RequiredSubs {
+		if !subs[name] {
+			violations = append(violations, fmt.Sprintf("Required sub %s is missing", name))
+		}
+	}
+	for _, name := range policy.RequiredIncludes {
+		if !includes[name] {
+			violations = append(violations, fmt.Sprintf("Required include \"%s\" is missing", name))
+		}
+	}
+	return violations
+}
+
+// findUnconditionalReturns finds return statements for action that are not
+// inside any if statement.
+func findUnconditionalReturns(statements []*vclStatement, action string) []*vclStatement {
+	found := []*vclStatement{}
+	for _, statement := range statements {
+		switch statement.Kind {
+		case "return":
+			if statement.Action == action {
+				found = append(found, statement)
+			}
+		case "{":
+			found = append(found, findUnconditionalReturns(statement.Blocks[0], action)...)
+		}
+	}
+	return found
+}
+
+func findInlineC(statements []*vclStatement) []*vclStatement {
+	return findStatements(statements, "C")
+}
+
+func findIncludes(statements []*vclStatement) []*vclStatement {
+	return findStatements(statements, "include")
+}
+
+// findStatements finds the statements of a kind at any depth.
+func findStatements(statements []*vclStatement, kind string) []*vclStatement {
+	found := []*vclStatement{}
+	for _, statement := range statements {
+		if statement.Kind == kind {
+			found = append(found, statement)
+		}
+		for _, block := range statement.Blocks {
+			found = append(found, findStatements(block, kind)...)
+		}
+	}
+	return found
+}
+
+// checkVclPolicy evaluates the configured policy, if any, returning the
+// violations and whether they should prevent the VCL being used.
+func checkVclPolicy(source string, program *vclProgram) (violations []string, refused bool) {
+	if vclDeployPolicy == nil {
+		return nil, false
+	}
+	violations = vclDeployPolicy.check(source, program)
+	return violations, len(violations) > 0 && vclDeployPolicy.Mode == vclPolicyModeEnforce
+}
+
+func formatVclPolicyViolations(violations []string, refused bool) string {
+	prefix := "VCL policy warning: "
+	if refused {
+		prefix = "VCL policy violation: "
+	}
+	return prefix + strings.Join(violations, "\n"+prefix)
+}
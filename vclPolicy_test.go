@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVclPolicyViolations(t *testing.T) {
+	source := `vcl 4.0;
+include "section.vcl";
+sub vcl_recv {
+    if (req.url ~ "^/admin") {
+        return (pass);
+    }
+    {
+        return (pass);
+    }
+    C{ printf("hello"); }C
+}
+`
+	program, syntaxError := parseVcl(source, 4)
+	if syntaxError != nil {
+		t.Fatal(syntaxError)
+	}
+
+	policy := &vclPolicy{
+		Mode:                          vclPolicyModeEnforce,
+		ForbidUnconditionalPassInRecv: true,
+		RequiredSubs:                  []string{"vcl_recv", "vcl_deliver"},
+		RequiredIncludes:              []string{"section.vcl", "security.vcl"},
+		MaxSize:                       100,
+		ForbidInlineC:                 true,
+	}
+	expected := []string{
+		"VCL is 171 bytes, larger than the limit of 100 bytes",
+		"return(pass) in vcl_recv without a condition (Line 8 Pos 9)",
+		"Inline C is not allowed (Line 10 Pos 5)",
+		"Required sub vcl_deliver is missing",
+		"Required include \"security.vcl\" is missing",
+	}
+	if actual := policy.check(source, program); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected violations %#v but were %#v.", expected, actual)
+	}
+}
+
+func TestVclPolicyWarnModeDoesNotRefuse(t *testing.T) {
+	defer func(previous *vclPolicy) { vclDeployPolicy = previous }(vclDeployPolicy)
+	vclDeployPolicy = &vclPolicy{Mode: vclPolicyModeWarn, RequiredSubs: []string{"vcl_deliver"}}
+
+	program, _ := parseVcl("vcl 4.0;", 4)
+	violations, refused := checkVclPolicy("vcl 4.0;", program)
+	if len(violations) != 1 || refused {
+		t.Errorf("Expected one violation that does not refuse but was %#v, %v.", violations, refused)
+	}
+}
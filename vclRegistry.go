@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+const (
+	vclStateAuto = "auto"
+	vclStateCold = "cold"
+	vclStateWarm = "warm"
+)
+
+type vclConfig struct {
+	Name        string   `json:"name"`
+	SourceName  string   `json:"sourceName"`
+	Source      string   `json:"source"`
+	State       string   `json:"state,omitempty"`
+	Personality string   `json:"personality,omitempty"`
+	Includes    []string `json:"includes,omitempty"`
+}
+
+// vclLabel is an alternative name for a VCL config, as created by vcl.label.
+type vclLabel struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+}
+
+type jsonVclRegistryState struct {
+	Active  string       `json:"active"`
+	Configs []*vclConfig `json:"configs"`
+	Labels  []*vclLabel  `json:"labels,omitempty"`
+}
+
+func isValidVclState(state string) bool {
+	return state == vclStateAuto || state == vclStateCold || state == vclStateWarm
+}
+
+// temperature reports whether the config would be warm or cold in varnishd,
+// where auto configs are only kept warm while active.
+func (config vclConfig) temperature(activeName string) string {
+	switch config.State {
+	case vclStateCold:
+		return vclStateCold
+	case vclStateWarm:
+		return vclStateWarm
+	}
+	if config.Name == activeName {
+		return vclStateWarm
+	}
+	return vclStateCold
+}
+
+// vclRegistry holds the VCL configs received via vcl.inline and vcl.load in
+// the order they were received, and remembers which one was last activated.
+// When statePath is set every change is saved there so that it survives a
+// restart of the bridge.
+type vclRegistry struct {
+	mutex      sync.Mutex
+	configs    []*vclConfig
+	labels     []*vclLabel
+	activeName string
+	statePath  string
+}
+
+func (registry *vclRegistry) find(name string) *vclConfig {
+	for _, config := range registry.configs {
+		if config.Name == name {
+			return config
+		}
+	}
+	return nil
+}
+
+func (registry *vclRegistry) findLabel(name string) *vclLabel {
+	for _, label := range registry.labels {
+		if label.Name == name {
+			return label
+		}
+	}
+	return nil
+}
+
+func (registry *vclRegistry) add(config vclConfig) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if registry.find(config.Name) != nil || registry.findLabel(config.Name) != nil {
+		return fmt.Errorf("Already a VCL program named %s", config.Name)
+	}
+	if config.State == "" {
+		config.State = vclStateAuto
+	}
+	if !isValidVclState(config.State) {
+		return fmt.Errorf("State must be one of auto, cold or warm.")
+	}
+	registry.configs = append(registry.configs, &config)
+	return registry.save()
+}
+
+func (registry *vclRegistry) get(name string) (config vclConfig, ok bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	found := registry.find(name)
+	if found == nil {
+		return vclConfig{}, false
+	}
+	return *found, true
+}
+
+// resolve is like get but also accepts the name of a label, in which case the
+// config the label points to is returned.
+func (registry *vclRegistry) resolve(name string) (config vclConfig, ok bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if label := registry.findLabel(name); label != nil {
+		name = label.Target
+	}
+	found := registry.find(name)
+	if found == nil {
+		return vclConfig{}, false
+	}
+	return *found, true
+}
+
+func (registry *vclRegistry) setState(name string, state string) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	config := registry.find(name)
+	if config == nil {
+		return fmt.Errorf("No configuration named %s known.", name)
+	}
+	if !isValidVclState(state) {
+		return fmt.Errorf("State must be one of auto, cold or warm.")
+	}
+	if state == vclStateCold && name == registry.activeName {
+		return fmt.Errorf("Cannot set the active VCL cold.")
+	}
+	config.State = state
+	return registry.save()
+}
+
+func (registry *vclRegistry) setLabel(labelName string, target string) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if registry.find(labelName) != nil {
+		return fmt.Errorf("%s is not a label", labelName)
+	}
+	if registry.findLabel(target) != nil {
+		return fmt.Errorf("VCL labels cannot point to labels")
+	}
+	if registry.find(target) == nil {
+		return fmt.Errorf("No configuration named %s known.", target)
+	}
+
+	if label := registry.findLabel(labelName); label != nil {
+		label.Target = target
+	} else {
+		registry.labels = append(registry.labels, &vclLabel{Name: labelName, Target: target})
+	}
+	return registry.save()
+}
+
+func (registry *vclRegistry) discard(name string) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if name == registry.activeName {
+		return fmt.Errorf("Cannot discard active VCL program")
+	}
+	for index, label := range registry.labels {
+		if label.Name == name {
+			registry.labels = append(registry.labels[:index], registry.labels[index+1:]...)
+			return registry.save()
+		}
+		if label.Target == name {
+			return fmt.Errorf("Cannot discard labeled (\"%s\") VCL program", label.Name)
+		}
+	}
+	for index, config := range registry.configs {
+		if config.Name == name {
+			last := len(registry.configs) - 1
+			copy(registry.configs[index:], registry.configs[index+1:])
+			// clear the vacated slot so the stored source can be collected
+			registry.configs[last] = nil
+			registry.configs = registry.configs[:last]
+			return registry.save()
+		}
+	}
+	return fmt.Errorf("No configuration named %s known.", name)
+}
+
+func (registry *vclRegistry) setActive(name string) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.activeName = name
+	return registry.save()
+}
+
+func (registry *vclRegistry) list() (configs []vclConfig, labels []vclLabel, activeName string) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	configs = make([]vclConfig, 0, len(registry.configs))
+	for _, config := range registry.configs {
+		configs = append(configs, *config)
+	}
+	labels = make([]vclLabel, 0, len(registry.labels))
+	for _, label := range registry.labels {
+		labels = append(labels, *label)
+	}
+	return configs, labels, registry.activeName
+}
+
+func (registry *vclRegistry) active() string {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	return registry.activeName
+}
+
+// load restores the registry from the state file at path, if it exists, and
+// saves all subsequent changes there.
+func (registry *vclRegistry) load(path string) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.statePath = path
+
+	stateBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read VCL registry state file '%s': %v", path, err)
+	}
+
+	var state jsonVclRegistryState
+	err = json.Unmarshal(stateBytes, &state)
+	if err != nil {
+		return fmt.Errorf("Failed to parse VCL registry state file '%s': %v", path, err)
+	}
+	for _, config := range state.Configs {
+		if config.State == "" {
+			config.State = vclStateAuto
+		}
+	}
+	registry.configs = state.Configs
+	registry.labels = state.Labels
+	registry.activeName = state.Active
+	return nil
+}
+
+// save must be called with the mutex held. The change is kept in memory
+// when saving fails, but the returned error tells the client it will not
+// survive a restart.
+func (registry *vclRegistry) save() error {
+	if registry.statePath == "" {
+		return nil
+	}
+
+	stateBytes, err := json.Marshal(jsonVclRegistryState{
+		Active:  registry.activeName,
+		Configs: registry.configs,
+		Labels:  registry.labels,
+	})
+	if err == nil {
+		err = writeFileAtomically(registry.statePath, stateBytes)
+	}
+	if err != nil {
+		log.Printf("Error saving VCL registry state to '%s': %v", registry.statePath, err)
+		return fmt.Errorf("Failed to save the VCL registry state.")
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVclListMarksActiveConfig(t *testing.T) {
+	listener := newTestListener("4.0")
+
+	listener.configs.add(vclConfig{Name: "first", SourceName: "<vcl.inline>", Source: "vcl 4.0;"})
+	listener.configs.add(vclConfig{Name: "second", SourceName: "<vcl.inline>", Source: "vcl 4.0;"})
+	listener.configs.setActive("second")
+
+	mockWriter := new(bytes.Buffer)
+	handleVarnishCliVclList(nil, &varnishCliSession{Writer: mockWriter, Listener: listener})
+	expected := "200 49      \navailable       0 first\nactive          0 second\n\n"
+	if actual := mockWriter.String(); actual != expected {
+		t.Errorf("Expected vcl.list response %#v but was %#v.", expected, actual)
+	}
+}
+
+func TestVclListIncludesTemperatureFrom41(t *testing.T) {
+	listener := newTestListener("4.1")
+
+	listener.configs.add(vclConfig{Name: "boot", SourceName: "<vcl.inline>", Source: "vcl 4.0;"})
+	listener.configs.setActive("boot")
+
+	mockWriter := new(bytes.Buffer)
+	handleVarnishCliVclList(nil, &varnishCliSession{Writer: mockWriter, Listener: listener})
+	expectedLine := "active     auto/warm          0 boot\n"
+	if actual := mockWriter.String(); !strings.Contains(actual, expectedLine) {
+		t.Errorf("Expected vcl.list response to contain %#v but was %#v.", expectedLine, actual)
+	}
+}
+
+func TestVclInlineRefusesDuplicateName(t *testing.T) {
+	listener := newTestListener("4.0")
+
+	handleVarnishCliVclInline("boot", "vcl 4.0;", "", &varnishCliSession{Writer: new(bytes.Buffer), Listener: listener})
+	mockWriter := new(bytes.Buffer)
+	handleVarnishCliVclInline("boot", "vcl 4.0;", "", &varnishCliSession{Writer: mockWriter, Listener: listener})
+	if actual := mockWriter.String(); !strings.HasPrefix(actual, "106 ") {
+		t.Errorf("Expected duplicate vcl.inline to be refused with 106 but was %#v.", actual)
+	}
+}
+
+func TestVclShowVerbosePrefixesSourceMarker(t *testing.T) {
+	listener := newTestListener("4.1")
+
+	listener.configs.add(vclConfig{Name: "boot", SourceName: "<vcl.inline>", Source: "vcl 4.0;"})
+
+	mockWriter := new(bytes.Buffer)
+	handleVarnishCliVclShow([]string{"-v", "boot"}, &varnishCliSession{Writer: mockWriter, Listener: listener})
+	expected := "200 37      \n// VCL.SHOW 0 8 <vcl.inline>\nvcl 4.0;\n"
+	if actual := mockWriter.String(); actual != expected {
+		t.Errorf("Expected vcl.show response %#v but was %#v.", expected, actual)
+	}
+}
+
+func TestResolveVclPathRefusesEscape(t *testing.T) {
+	defer func(previous string) { vclDirectory = previous }(vclDirectory)
+	root, err := ioutil.TempDir("", "vcl-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	vclDirectory = filepath.Join(root, "vcl")
+	os.Mkdir(vclDirectory, 0755)
+	ioutil.WriteFile(filepath.Join(vclDirectory, "default.vcl"), []byte("vcl 4.0;"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "secret"), []byte("secret"), 0644)
+	os.Symlink(filepath.Join(root, "secret"), filepath.Join(vclDirectory, "link.vcl"))
+
+	if _, err := resolveVclPath("default.vcl"); err != nil {
+		t.Errorf("Expected default.vcl to resolve but got %v.", err)
+	}
+	for _, filename := range []string{"../secret", filepath.Join(root, "secret"), "link.vcl"} {
+		if path, err := resolveVclPath(filename); err == nil {
+			t.Errorf("Expected %#v to be refused but resolved to %#v.", filename, path)
+		}
+	}
+}
+
+func TestVclDiscardRefusesActiveConfig(t *testing.T) {
+	listener := newTestListener("4.0")
+
+	listener.configs.add(vclConfig{Name: "old", SourceName: "<vcl.inline>", Source: "vcl 4.0;"})
+	listener.configs.add(vclConfig{Name: "new", SourceName: "<vcl.inline>", Source: "vcl 4.0;"})
+	listener.configs.setActive("new")
+
+	mockWriter := new(bytes.Buffer)
+	handleVarnishCliVclDiscard("new", &varnishCliSession{Writer: mockWriter, Listener: listener})
+	expected := "106 33      \nCannot discard active VCL program\n"
+	if actual := mockWriter.String(); actual != expected {
+		t.Errorf("Expected discard of active config to respond %#v but was %#v.", expected, actual)
+	}
+
+	mockWriter.Reset()
+	handleVarnishCliVclDiscard("old", &varnishCliSession{Writer: mockWriter, Listener: listener})
+	if actual := mockWriter.String(); !strings.HasPrefix(actual, "200 ") {
+		t.Errorf("Expected discard of inactive config to succeed but was %#v.", actual)
+	}
+	if _, ok := listener.configs.get("old"); ok {
+		t.Errorf("Expected discarded config to be removed from the registry.")
+	}
+	if _, ok := listener.configs.get("new"); !ok {
+		t.Errorf("Expected active config to remain in the registry.")
+	}
+}
+
+func TestVclRegistryIsRestoredFromStateFile(t *testing.T) {
+	stateDirectory, err := ioutil.TempDir("", "state-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDirectory)
+	statePath := filepath.Join(stateDirectory, "vcl-registry.json")
+
+	before := &vclRegistry{}
+	if err := before.load(statePath); err != nil {
+		t.Fatalf("Expected missing state file to be ignored but got %v.", err)
+	}
+	before.add(vclConfig{Name: "old", SourceName: "<vcl.inline>", Source: "vcl 4.0;"})
+	before.add(vclConfig{Name: "new", SourceName: "/etc/varnish/new.vcl", Source: "vcl 4.0; # new"})
+	before.setActive("new")
+	before.discard("old")
+
+	after := &vclRegistry{}
+	if err := after.load(statePath); err != nil {
+		t.Fatalf("Expected state file to load but got %v.", err)
+	}
+	configs, _, activeName := after.list()
+	if activeName != "new" {
+		t.Errorf("Expected restored active config to be %#v but was %#v.", "new", activeName)
+	}
+	expected := []vclConfig{{Name: "new", SourceName: "/etc/varnish/new.vcl", Source: "vcl 4.0; # new", State: "auto"}}
+	if !reflect.DeepEqual(configs, expected) {
+		t.Errorf("Expected restored configs %#v but were %#v.", expected, configs)
+	}
+}
+
+func TestVclLabelIsListedAndResolved(t *testing.T) {
+	listener := newTestListener("5.0")
+
+	listener.configs.add(vclConfig{Name: "boot", SourceName: "<vcl.inline>", Source: "vcl 4.0;", State: "warm"})
+	handleVarnishCliVclLabel("production", "boot", &varnishCliSession{Writer: new(bytes.Buffer), Listener: listener})
+
+	if config, ok := listener.configs.resolve("production"); !ok || config.Name != "boot" {
+		t.Errorf("Expected label to resolve to boot but was %#v.", config)
+	}
+
+	mockWriter := new(bytes.Buffer)
+	handleVarnishCliVclList(nil, &varnishCliSession{Writer: mockWriter, Listener: listener})
+	expectedLine := "available  label/warm          0 production -> boot\n"
+	if actual := mockWriter.String(); !strings.Contains(actual, expectedLine) {
+		t.Errorf("Expected vcl.list response to contain %#v but was %#v.", expectedLine, actual)
+	}
+
+	if err := listener.configs.discard("boot"); err == nil {
+		t.Errorf("Expected discard of labelled config to be refused.")
+	}
+	if err := listener.configs.setState("boot", "lukewarm"); err == nil {
+		t.Errorf("Expected invalid state to be refused.")
+	}
+}
+
+func TestVclUseRequiresConfigName(t *testing.T) {
+	mockWriter := new(bytes.Buffer)
+	handleRequest("vcl.use", &varnishCliSession{Writer: mockWriter, HasAuthenticated: true, Listener: newTestListener("4.0")})
+	expected := "104 18      \nToo few parameters\n"
+	if actual := mockWriter.String(); actual != expected {
+		t.Errorf("Expected vcl.use without a name to respond %#v but was %#v.", expected, actual)
+	}
+}
+
+func TestVclRegistryReportsFailedSave(t *testing.T) {
+	stateDirectory, err := ioutil.TempDir("", "state-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newTestListener("4.0")
+	if err := listener.loadState(stateDirectory); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkStateDirectory(stateDirectory); err != nil {
+		t.Errorf("Expected the state directory to be writable but was %v.", err)
+	}
+	os.RemoveAll(stateDirectory)
+	if err := checkStateDirectory(stateDirectory); err == nil {
+		t.Errorf("Expected the missing state directory to be refused.")
+	}
+
+	mockWriter := new(bytes.Buffer)
+	handleRequest(`vcl.inline boot "vcl 4.0;"`, &varnishCliSession{Writer: mockWriter, HasAuthenticated: true, Listener: listener})
+	if actual := mockWriter.String(); strings.HasPrefix(actual, "200 ") || !strings.Contains(actual, "Failed to save the VCL registry state.") {
+		t.Errorf("Expected the client to be told the change was not saved but was %#v.", actual)
+	}
+}
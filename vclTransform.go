@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// vclTransformStep is one stage of the pipeline applied to VCL source before
+// it is deployed to section.io.
+type vclTransformStep struct {
+	Name  string
+	Apply func(source string) (string, error)
+}
+
+var vclTransformPipeline []vclTransformStep
+
+// defaultVclEnvPrefix is the prefix of the environment variables which
+// substitute-env may use when it is not given others.
+const defaultVclEnvPrefix = "VCL_"
+
+// forbiddenVclEnvPrefixes name the configuration of the bridge itself, such
+// as the section.io password, which must never reach VCL a client can show.
+var forbiddenVclEnvPrefixes = []string{"SECTION_IO_", "VARNISH_CLI_BRIDGE_"}
+
+var (
+	vclEnvPlaceholderRx = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	vclVersionRx        = regexp.MustCompile(`^\d+\.\d+$`)
+)
+
+// parseVclTransforms builds the pipeline from a comma-separated list of steps,
+// some of which take an argument after an equals sign, eg
+// "strip-backends,substitute-env,vcl-version=4.0".
+func parseVclTransforms(spec string) ([]vclTransformStep, error) {
+	steps := []vclTransformStep{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, argument := item, ""
+		if index := strings.Index(item, "="); index >= 0 {
+			name, argument = item[:index], item[index+1:]
+		}
+
+		var apply func(string) (string, error)
+		switch name {
+		case "strip-backends":
+			apply = stripVclBlocks("backend", "")
+		case "strip-directors":
+			apply = stripVclBlocks("director", "")
+		case "strip-acls":
+			apply = stripVclBlocks("acl", "")
+		case "replace-backends", "replace-directors":
+			if argument == "" {
+				return nil, fmt.Errorf("VCL transform '%s' requires a file", name)
+			}
+			keyword := strings.TrimSuffix(strings.TrimPrefix(name, "replace-"), "s")
+			file := argument
+			apply = func(source string) (string, error) {
+				replacement, err := readVclSnippet(file)
+				if err != nil {
+					return "", err
+				}
+				return stripVclBlocks(keyword, replacement)(source)
+			}
+		case "substitute-env":
+			prefixes := []string{defaultVclEnvPrefix}
+			if argument != "" {
+				prefixes = strings.Split(argument, ":")
+			}
+			for _, prefix := range prefixes {
+				if prefix == "" {
+					return nil, fmt.Errorf("VCL transform '%s' requires non-empty prefixes", name)
+				}
+			}
+			apply = substituteVclEnv(prefixes)
+		case "include":
+			if argument == "" {
+				return nil, fmt.Errorf("VCL transform '%s' requires a file", name)
+			}
+			file := argument
+			apply = func(source string) (string, error) {
+				snippet, err := readVclSnippet(file)
+				if err != nil {
+					return "", err
+				}
+				return injectVclSnippet(source, snippet)
+			}
+		case "vcl-version":
+			if !vclVersionRx.MatchString(argument) {
+				return nil, fmt.Errorf("VCL transform '%s' requires a version like 4.0", name)
+			}
+			vclVersion := argument
+			apply = func(source string) (string, error) {
+				return normaliseVclVersion(source, vclVersion)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown VCL transform '%s'", name)
+		}
+		steps = append(steps, vclTransformStep{Name: item, Apply: apply})
+	}
+	return steps, nil
+}
+
+func transformVcl(source string) (string, error) {
+	for _, step := range vclTransformPipeline {
+		transformed, err := step.Apply(source)
+		if err != nil {
+			return "", fmt.Errorf("VCL transform '%s' failed: %v", step.Name, err)
+		}
+		source = transformed
+	}
+	return source, nil
+}
+
+// readVclSnippet reads a file named by a transform, relative to the VCL
+// directory when one is configured.
+func readVclSnippet(file string) (string, error) {
+	if vclDirectory != "" && !filepath.IsAbs(file) {
+		file = filepath.Join(vclDirectory, file)
+	}
+	snippetBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return string(snippetBytes), nil
+}
+
+// findVclBlocks returns the byte ranges of the top-level declarations
+// starting with keyword, eg "backend default { ... }".
+func findVclBlocks(source string, keyword string) ([][2]int, error) {
+	tokens, syntaxError := lexVcl(source)
+	if syntaxError != nil {
+		return nil, syntaxError
+	}
+
+	blocks := [][2]int{}
+	depth := 0
+	for index := 0; index < len(tokens); index++ {
+		token := tokens[index]
+		switch {
+		case token.Text == "{":
+			depth++
+		case token.Text == "}":
+			depth--
+		case depth == 0 && token.Type == vclTokenIdent && token.Text == keyword:
+			open := index + 1
+			for open < len(tokens) && tokens[open].Text != "{" && tokens[open].Text != ";" {
+				open++
+			}
+			if open >= len(tokens) || tokens[open].Text != "{" {
+				continue
+			}
+			closing, nesting := open, 0
+			for ; closing < len(tokens); closing++ {
+				if tokens[closing].Text == "{" {
+					nesting++
+				} else if tokens[closing].Text == "}" {
+					nesting--
+					if nesting == 0 {
+						break
+					}
+				}
+			}
+			if closing >= len(tokens) {
+				return nil, fmt.Errorf("Unterminated %s declaration at line %d", keyword, token.Line)
+			}
+			end := tokens[closing].End
+			// take the rest of the line with the block
+			if end < len(source) && source[end] == '\n' {
+				end++
+			}
+			blocks = append(blocks, [2]int{token.Start, end})
+			index = closing
+		}
+	}
+	return blocks, nil
+}
+
+// stripVclBlocks removes every top-level declaration of the given kind,
+// putting replacement in place of the first one.
+func stripVclBlocks(keyword string, replacement string) func(string) (string, error) {
+	return func(source string) (string, error) {
+		blocks, err := findVclBlocks(source, keyword)
+		if err != nil {
+			return "", err
+		}
+
+		var result bytes.Buffer
+		previous := 0
+		for index, block := range blocks {
+			result.WriteString(source[previous:block[0]])
+			if index == 0 {
+				result.WriteString(replacement)
+			}
+			previous = block[1]
+		}
+		result.WriteString(source[previous:])
+		return result.String(), nil
+	}
+}
+
+// vclEnvAllowed reports whether a placeholder may be replaced by the
+// environment variable of the given name.
+func vclEnvAllowed(name string, prefixes []string) bool {
+	for _, prefix := range forbiddenVclEnvPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// substituteVclEnv replaces placeholders of environment variables with one of
+// the prefixes, refusing others, as the client which sent the VCL can see the
+// result with vcl.preview.
+func substituteVclEnv(prefixes []string) func(string) (string, error) {
+	return func(source string) (string, error) {
+		var missing, refused []string
+		result := vclEnvPlaceholderRx.ReplaceAllStringFunc(source, func(placeholder string) string {
+			name := vclEnvPlaceholderRx.FindStringSubmatch(placeholder)[1]
+			if !vclEnvAllowed(name, prefixes) {
+				refused = append(refused, name)
+				return placeholder
+			}
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+				return placeholder
+			}
+			return value
+		})
+		if len(refused) > 0 {
+			return "", fmt.Errorf("Environment variables may not be substituted: %s", strings.Join(refused, ", "))
+		}
+		if len(missing) > 0 {
+			return "", fmt.Errorf("Environment variables not set: %s", strings.Join(missing, ", "))
+		}
+		return result, nil
+	}
+}
+
+// findVclVersionDeclaration returns the byte range of the "vcl X.Y;"
+// declaration, which must be the first thing in the source.
+func findVclVersionDeclaration(source string) (start int, end int, found bool, err error) {
+	tokens, syntaxError := lexVcl(source)
+	if syntaxError != nil {
+		return 0, 0, false, syntaxError
+	}
+	if len(tokens) >= 3 && tokens[0].Text == "vcl" && tokens[1].Type == vclTokenNumber && tokens[2].Text == ";" {
+		return tokens[0].Start, tokens[2].End, true, nil
+	}
+	return 0, 0, false, nil
+}
+
+// injectVclSnippet inserts snippet after the VCL version declaration, or at
+// the top when there is none.
+func injectVclSnippet(source string, snippet string) (string, error) {
+	_, end, found, err := findVclVersionDeclaration(source)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(snippet, "\n") {
+		snippet += "\n"
+	}
+	if !found {
+		return snippet + source, nil
+	}
+	return source[:end] + "\n" + snippet + source[end:], nil
+}
+
+func normaliseVclVersion(source string, vclVersion string) (string, error) {
+	start, end, found, err := findVclVersionDeclaration(source)
+	if err != nil {
+		return "", err
+	}
+	declaration := "vcl " + vclVersion + ";"
+	if !found {
+		return declaration + "\n" + source, nil
+	}
+	return source[:start] + declaration + source[end:], nil
+}
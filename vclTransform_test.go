@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+const turpentineStyleVcl = `vcl 4.0;
+
+import std;
+
+backend default {
+    .host = "127.0.0.1";
+    .port = "8080";
+    .probe = { .url = "/"; }
+}
+
+acl purge {
+    "localhost";
+}
+
+sub vcl_recv {
+    # a "backend" keyword in a comment { is ignored
+    set req.http.X-Secret = "${TURPENTINE_SECRET}";
+}
+`
+
+func TestVclTransformPipeline(t *testing.T) {
+	defer func(previous []vclTransformStep) { vclTransformPipeline = previous }(vclTransformPipeline)
+	os.Setenv("TURPENTINE_SECRET", "s3cr3t")
+	defer os.Unsetenv("TURPENTINE_SECRET")
+
+	var err error
+	vclTransformPipeline, err = parseVclTransforms("strip-backends, strip-acls,substitute-env=TURPENTINE_,vcl-version=4.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := transformVcl(turpentineStyleVcl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `vcl 4.1;
+
+import std;
+
+
+
+sub vcl_recv {
+    # a "backend" keyword in a comment { is ignored
+    set req.http.X-Secret = "s3cr3t";
+}
+`
+	if actual != expected {
+		t.Errorf("Expected transformed VCL %#v but was %#v.", expected, actual)
+	}
+}
+
+func TestVclTransformFailsOnMissingEnv(t *testing.T) {
+	os.Unsetenv("VCL_TEST_UNSET")
+	if _, err := substituteVclEnv([]string{defaultVclEnvPrefix})(`"${VCL_TEST_UNSET}"`); err == nil {
+		t.Errorf("Expected substitution of an unset variable to fail.")
+	}
+}
+
+func TestVclTransformRefusesDisallowedEnv(t *testing.T) {
+	os.Setenv("SECTION_IO_PASSWORD", "s3cr3t")
+	defer os.Unsetenv("SECTION_IO_PASSWORD")
+	os.Setenv("HOME_TEST", "/root")
+	defer os.Unsetenv("HOME_TEST")
+
+	for _, prefixes := range [][]string{{defaultVclEnvPrefix}, {"SECTION_"}} {
+		for _, source := range []string{`"${SECTION_IO_PASSWORD}"`, `"${HOME_TEST}"`} {
+			actual, err := substituteVclEnv(prefixes)(source)
+			if err == nil || strings.Contains(actual, "s3cr3t") {
+				t.Errorf("Expected %s to be refused with prefixes %#v but was %#v.", source, prefixes, actual)
+			}
+		}
+	}
+
+	if _, err := parseVclTransforms("substitute-env=VCL_:"); err == nil {
+		t.Errorf("Expected an empty prefix to be refused.")
+	}
+}
+
+func TestInjectVclSnippetAfterVersion(t *testing.T) {
+	actual, err := injectVclSnippet("vcl 4.0;\nsub vcl_recv {}\n", "include \"section.vcl\";")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "vcl 4.0;\ninclude \"section.vcl\";\n\nsub vcl_recv {}\n"
+	if actual != expected {
+		t.Errorf("Expected injected VCL %#v but was %#v.", expected, actual)
+	}
+}
+
+func TestParseVclTransformsRejectsUnknownStep(t *testing.T) {
+	if _, err := parseVclTransforms("strip-backends,frobnicate"); err == nil {
+		t.Errorf("Expected unknown transform to be rejected.")
+	}
+}